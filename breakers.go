@@ -0,0 +1,184 @@
+package httpproxyfailover
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is the error for a backend HTTP proxy skipped by Breakers.
+var ErrCircuitOpen = errors.New("circuit open")
+
+// BreakerState is the state of a circuit breaker.
+type BreakerState int
+
+const (
+	// BreakerClosed lets all the trials through.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen skips all the trials.
+	BreakerOpen
+	// BreakerHalfOpen lets a single trial through to decide whether to close or open the circuit again.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// Breakers are circuit breakers for each backend HTTP proxy.
+// A circuit opens after consecutive failures and Proxy skips the backend HTTP proxy while it's open. After CoolDown,
+// it becomes half-open and lets a single trial through. The circuit closes if the trial succeeds, otherwise it opens
+// again.
+type Breakers struct {
+	// Threshold is the number of consecutive failures to open a circuit. If it's 0, 5 is used.
+	Threshold int
+
+	// CoolDown is the duration for which a circuit stays open. If it's 0, 30 seconds is used.
+	CoolDown time.Duration
+
+	// OnStateChange is signaled after a circuit changes its state if provided.
+	OnStateChange func(backend string, from, to BreakerState)
+
+	mu       sync.Mutex
+	circuits map[string]*circuit
+}
+
+type circuit struct {
+	state    BreakerState
+	failures int
+	opened   time.Time
+	trial    bool
+}
+
+// State returns the state of the circuit for the backend.
+func (b *Breakers) State(backend string) BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, ok := b.circuits[backend]
+	if !ok {
+		return BreakerClosed
+	}
+	return c.state
+}
+
+func (b *Breakers) allow(backend string) bool {
+	b.mu.Lock()
+	c := b.circuit(backend)
+	var ok, changed bool
+	switch c.state {
+	case BreakerClosed:
+		ok = true
+	case BreakerOpen:
+		if time.Since(c.opened) >= b.coolDown() {
+			c.state = BreakerHalfOpen
+			c.trial = true
+			ok, changed = true, true
+		}
+	case BreakerHalfOpen:
+		if !c.trial {
+			c.trial = true
+			ok = true
+		}
+	}
+	b.mu.Unlock()
+
+	if changed {
+		b.changed(backend, BreakerOpen, BreakerHalfOpen)
+	}
+	return ok
+}
+
+func (b *Breakers) record(backend string, err error) {
+	b.mu.Lock()
+	c := b.circuit(backend)
+	from := c.state
+	switch {
+	case errors.Is(err, context.Canceled):
+		// The trial was canceled halfway. It doesn't tell anything about the backend.
+		c.trial = false
+	case err == nil:
+		c.state = BreakerClosed
+		c.failures = 0
+		c.trial = false
+	default:
+		c.failures++
+		c.trial = false
+		if c.state == BreakerHalfOpen || c.failures >= b.threshold() {
+			c.state = BreakerOpen
+			c.opened = time.Now()
+		}
+	}
+	to := c.state
+	b.mu.Unlock()
+
+	if from != to {
+		b.changed(backend, from, to)
+	}
+}
+
+// release lets the half-open circuit for the backend allow another trial if the allowed one didn't start.
+func (b *Breakers) release(backend string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.circuit(backend)
+	if c.state == BreakerHalfOpen {
+		c.trial = false
+	}
+}
+
+// trip opens the circuit for the backend regardless of Threshold.
+func (b *Breakers) trip(backend string) {
+	b.mu.Lock()
+	c := b.circuit(backend)
+	from := c.state
+	c.state = BreakerOpen
+	c.opened = time.Now()
+	c.trial = false
+	b.mu.Unlock()
+
+	if from != BreakerOpen {
+		b.changed(backend, from, BreakerOpen)
+	}
+}
+
+func (b *Breakers) circuit(backend string) *circuit {
+	if b.circuits == nil {
+		b.circuits = map[string]*circuit{}
+	}
+	c, ok := b.circuits[backend]
+	if !ok {
+		c = &circuit{}
+		b.circuits[backend] = c
+	}
+	return c
+}
+
+func (b *Breakers) changed(backend string, from, to BreakerState) {
+	if b.OnStateChange != nil {
+		b.OnStateChange(backend, from, to)
+	}
+}
+
+func (b *Breakers) threshold() int {
+	if b.Threshold == 0 {
+		return 5
+	}
+	return b.Threshold
+}
+
+func (b *Breakers) coolDown() time.Duration {
+	if b.CoolDown == 0 {
+		return 30 * time.Second
+	}
+	return b.CoolDown
+}
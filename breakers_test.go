@@ -0,0 +1,67 @@
+package httpproxyfailover
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBreakers(t *testing.T) {
+	type change struct {
+		backend  string
+		from, to BreakerState
+	}
+	var changes []change
+	b := Breakers{
+		Threshold: 2,
+		CoolDown:  10 * time.Millisecond,
+		OnStateChange: func(backend string, from, to BreakerState) {
+			changes = append(changes, change{backend: backend, from: from, to: to})
+		},
+	}
+	errFailed := errors.New("failed")
+
+	assert.True(t, b.allow("a"))
+	b.record("a", errFailed)
+	assert.Equal(t, BreakerClosed, b.State("a"))
+	b.record("a", nil)
+	b.record("a", errFailed)
+	assert.Equal(t, BreakerClosed, b.State("a"))
+	b.record("a", errFailed)
+	assert.Equal(t, BreakerOpen, b.State("a"))
+	assert.False(t, b.allow("a"))
+	assert.True(t, b.allow("b"))
+
+	// A single trial after the cool-down.
+	time.Sleep(10 * time.Millisecond)
+	assert.True(t, b.allow("a"))
+	assert.Equal(t, BreakerHalfOpen, b.State("a"))
+	assert.False(t, b.allow("a"))
+
+	// Cancellation doesn't count.
+	b.record("a", context.Canceled)
+	assert.Equal(t, BreakerHalfOpen, b.State("a"))
+	assert.True(t, b.allow("a"))
+
+	// A failure opens it again.
+	b.record("a", errFailed)
+	assert.Equal(t, BreakerOpen, b.State("a"))
+
+	// A success closes it.
+	time.Sleep(10 * time.Millisecond)
+	assert.True(t, b.allow("a"))
+	b.record("a", nil)
+	assert.Equal(t, BreakerClosed, b.State("a"))
+	assert.True(t, b.allow("a"))
+
+	assert.Equal(t, []change{
+		{backend: "a", from: BreakerClosed, to: BreakerOpen},
+		{backend: "a", from: BreakerOpen, to: BreakerHalfOpen},
+		{backend: "a", from: BreakerHalfOpen, to: BreakerOpen},
+		{backend: "a", from: BreakerOpen, to: BreakerHalfOpen},
+		{backend: "a", from: BreakerHalfOpen, to: BreakerClosed},
+	}, changes)
+}
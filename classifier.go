@@ -0,0 +1,52 @@
+package httpproxyfailover
+
+import "errors"
+
+// Verdict is what Proxy does after a failed trial of a backend HTTP proxy.
+type Verdict int
+
+const (
+	// FailOver tries the next backend HTTP proxy.
+	FailOver Verdict = iota
+	// FailFast stops trials and responds to the CONNECT request with 502 Bad Gateway immediately.
+	FailFast
+	// MarkUnhealthy tries the next backend HTTP proxy and skips the failed one from then on. It opens the circuit of
+	// the backend HTTP proxy in Proxy.Breakers and marks it unhealthy in Proxy.HealthCheck if provided.
+	MarkUnhealthy
+)
+
+func (v Verdict) String() string {
+	switch v {
+	case FailOver:
+		return "fail-over"
+	case FailFast:
+		return "fail-fast"
+	case MarkUnhealthy:
+		return "mark-unhealthy"
+	default:
+		return "unknown"
+	}
+}
+
+// StatusCode returns the status code of the response from a backend HTTP proxy if err is caused by an unsuccessful
+// status code.
+func StatusCode(err error) (int, bool) {
+	var e *unsuccessfulStatusError
+	if !errors.As(err, &e) {
+		return 0, false
+	}
+	return e.statusCode, true
+}
+
+// StatusClassifier classifies failed trials by the status codes of the responses from backend HTTP proxies.
+// Failures without status codes or with unknown status codes are classified as FailOver.
+type StatusClassifier map[int]Verdict
+
+// Classify returns the Verdict for the status code of err.
+func (c StatusClassifier) Classify(_ string, err error) Verdict {
+	code, ok := StatusCode(err)
+	if !ok {
+		return FailOver
+	}
+	return c[code]
+}
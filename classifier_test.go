@@ -0,0 +1,34 @@
+package httpproxyfailover
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatusCode(t *testing.T) {
+	code, ok := StatusCode(&unsuccessfulStatusError{statusCode: http.StatusForbidden})
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusForbidden, code)
+
+	code, ok = StatusCode(fmt.Errorf("wrapped: %w", &unsuccessfulStatusError{statusCode: http.StatusBadGateway}))
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusBadGateway, code)
+
+	_, ok = StatusCode(errors.New("failed"))
+	assert.False(t, ok)
+}
+
+func TestStatusClassifier_Classify(t *testing.T) {
+	c := StatusClassifier{
+		http.StatusProxyAuthRequired: FailFast,
+		http.StatusForbidden:         MarkUnhealthy,
+	}
+	assert.Equal(t, FailFast, c.Classify("a", &unsuccessfulStatusError{statusCode: http.StatusProxyAuthRequired}))
+	assert.Equal(t, MarkUnhealthy, c.Classify("a", &unsuccessfulStatusError{statusCode: http.StatusForbidden}))
+	assert.Equal(t, FailOver, c.Classify("a", &unsuccessfulStatusError{statusCode: http.StatusBadGateway}))
+	assert.Equal(t, FailOver, c.Classify("a", errors.New("failed")))
+}
@@ -2,11 +2,16 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
+	"math"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 
@@ -24,30 +29,108 @@ func init() {
 
 func main() {
 	var port int
+	var socksPort int
 	var timeout time.Duration
+	var deadline time.Duration
+	var maxAttempts int
+	var retries int
+	var retryBackoff time.Duration
+	var maxRetryBackoff time.Duration
+	var retryBudget float64
+	var retryBudgetMin float64
+	var race int
+	var hedge time.Duration
 	var tlsHandshake bool
 	var favicon bool
 	var get []string
+	var strategy string
+	var tierStrategies map[string]string
+	var healthInterval time.Duration
+	var healthTarget string
+	var healthRise int
+	var healthFall int
+	var breakerThreshold int
+	var breakerCoolDown time.Duration
+	var outlierWindow int
+	var outlierEjectionTime time.Duration
+	var outlierMaxEjectionTime time.Duration
+	var outlierMaxEjectionPercent int
+	var slowStart time.Duration
+	var sessionKey string
+	var sessionTTL time.Duration
+	var failFast []int
+	var markUnhealthy []int
+	var errorResponse string
+	var name string
+	var retryAfter time.Duration
+	var proxyCA string
+	var proxyCert string
+	var proxyKey string
 
 	pflag.IntVarP(&port, "port", "p", 0, "Specify port number to listen on (random if not specified)")
+	pflag.IntVar(&socksPort, "socks-port", 0, "Specify port number to listen on for SOCKS5 and SOCKS4 clients (disabled if not specified)")
 	pflag.DurationVarP(&timeout, "timeout", "t", 0, "Set timeout for each trial")
+	pflag.DurationVarP(&deadline, "deadline", "d", 0, "Set deadline for all trials of each CONNECT request")
+	pflag.IntVarP(&maxAttempts, "max-attempts", "m", 0, "Limit the number of trials of each CONNECT request")
+	pflag.IntVar(&retries, "retries", 0, "Retry all backends the number of times after they all fail")
+	pflag.DurationVar(&retryBackoff, "retry-backoff", 100*time.Millisecond, "Set base delay before retries")
+	pflag.DurationVar(&maxRetryBackoff, "max-retry-backoff", 10*time.Second, "Set maximum delay before retries")
+	pflag.Float64Var(&retryBudget, "retry-budget", 0, "Limit trials beyond the first to the percentage of CONNECT requests (no limit if not specified)")
+	pflag.Float64Var(&retryBudgetMin, "retry-budget-min", 10, "Allow the number of trials beyond the first per second regardless of the retry budget")
+	pflag.IntVarP(&race, "race", "r", 1, "Try the number of backends at once")
+	pflag.DurationVar(&hedge, "hedge", 0, "Try the next backend in parallel after the delay")
 	pflag.BoolVarP(&tlsHandshake, "tls", "T", false, "Check TLS handshake")
 	pflag.BoolVarP(&favicon, "favicon", "f", false, "Check Favicon")
 	pflag.StringSliceVarP(&get, "get", "g", nil, "Check GET")
+	pflag.StringVarP(&strategy, "strategy", "s", "in-order", "Select backends by strategy (in-order, round-robin, random, weighted, least-tunnels, least-latency, consistent-hash)")
+	pflag.StringToStringVar(&tierStrategies, "tier-strategy", nil, "Select backends in the tier by strategy (e.g. 2=random)")
+	pflag.DurationVar(&healthInterval, "health-interval", 0, "Run checks in background at the interval instead of for each trial")
+	pflag.StringVar(&healthTarget, "health-target", "example.com:443", "Set host and port to CONNECT for background checks")
+	pflag.IntVar(&healthRise, "health-rise", 2, "Consider backends healthy after the number of consecutive successes")
+	pflag.IntVar(&healthFall, "health-fall", 3, "Consider backends unhealthy after the number of consecutive failures")
+	pflag.IntVar(&breakerThreshold, "breaker-threshold", 0, "Skip backends after the number of consecutive failures (never if not specified)")
+	pflag.DurationVar(&breakerCoolDown, "breaker-cooldown", 30*time.Second, "Set cool-down before retrying skipped backends")
+	pflag.IntVar(&outlierWindow, "outlier-window", 0, "Eject outliers by failure rates of the number of latest trials (never if not specified)")
+	pflag.DurationVar(&outlierEjectionTime, "outlier-ejection-time", 30*time.Second, "Set base duration of ejection")
+	pflag.DurationVar(&outlierMaxEjectionTime, "outlier-max-ejection-time", 300*time.Second, "Set maximum duration of ejection")
+	pflag.IntVar(&outlierMaxEjectionPercent, "outlier-max-ejection-percent", 10, "Set maximum percentage of ejected backends")
+	pflag.DurationVar(&slowStart, "slow-start", 0, "Ramp up the share of new or recovered backends over the duration")
+	pflag.StringVar(&sessionKey, "session-key", "", "Pin sessions identified by the variable to backends")
+	pflag.DurationVar(&sessionTTL, "session-ttl", 0, "Set TTL for pinned sessions (no expiration if not specified)")
+	pflag.IntSliceVar(&failFast, "fail-fast", nil, "Respond immediately without fail-over if a backend responds with any of the status codes")
+	pflag.IntSliceVar(&markUnhealthy, "mark-unhealthy", nil, "Skip backends which respond with any of the status codes from then on")
+	pflag.StringVar(&errorResponse, "error-response", "", "Respond with details after all backends fail (text, json, relay-last)")
+	pflag.StringVar(&name, "name", "httpproxyfailover", "Identify this proxy in Proxy-Status header")
+	pflag.DurationVar(&retryAfter, "retry-after", 10*time.Second, "Set Retry-After header when no backend is applicable")
+	pflag.StringVar(&proxyCA, "proxy-ca", "", "Verify backend HTTPS proxies with CA certificates in the PEM file")
+	pflag.StringVar(&proxyCert, "proxy-cert", "", "Authenticate to backend HTTPS proxies with the client certificate in the PEM file")
+	pflag.StringVar(&proxyKey, "proxy-key", "", "Set the PEM file of the private key for --proxy-cert")
 	pflag.Parse()
 
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGINT)
 
 	p := httpproxyfailover.Proxy{
-		Backends: pflag.Args(),
-		Timeout:  timeout,
+		Backends:        pflag.Args(),
+		Name:            name,
+		RetryAfter:      retryAfter,
+		Timeout:         timeout,
+		Deadline:        deadline,
+		MaxAttempts:     maxAttempts,
+		Retries:         retries,
+		RetryBackoff:    retryBackoff,
+		MaxRetryBackoff: maxRetryBackoff,
+		Race:            race,
+		HedgeDelay:      hedge,
 		OnConnect: func(r *http.Request, b string, err error) {
 			log := logrus.WithFields(logrus.Fields{
 				"from": r.RemoteAddr,
 				"to":   r.RequestURI,
 				"via":  b,
 			})
+			if b, ok := httpproxyfailover.TrialBackend(r); ok {
+				log = log.WithField("tier", b.Tier)
+			}
 			if err != nil {
 				log.WithError(err).Warn("fail-over")
 				return
@@ -62,16 +145,163 @@ func main() {
 		},
 	}
 
+	selector, err := newSelector(strategy, &p)
+	if err != nil {
+		logrus.WithError(err).Fatal("failed to select strategy")
+	}
+	p.Selector = selector
+
+	for t, s := range tierStrategies {
+		tier, err := strconv.Atoi(t)
+		if err != nil {
+			logrus.WithError(err).Fatal("failed to parse tier")
+		}
+		selector, err := newSelector(s, &p)
+		if err != nil {
+			logrus.WithError(err).Fatal("failed to select strategy")
+		}
+		if p.Tiers == nil {
+			p.Tiers = map[int]httpproxyfailover.Selector{}
+		}
+		p.Tiers[tier] = selector
+	}
+
+	if breakerThreshold > 0 || (len(markUnhealthy) > 0 && healthInterval == 0) {
+		threshold := breakerThreshold
+		if threshold == 0 {
+			// Circuits open only for backends marked unhealthy.
+			threshold = math.MaxInt32
+		}
+		p.Breakers = &httpproxyfailover.Breakers{
+			Threshold: threshold,
+			CoolDown:  breakerCoolDown,
+			OnStateChange: func(b string, from, to httpproxyfailover.BreakerState) {
+				logrus.WithFields(logrus.Fields{
+					"via":  b,
+					"from": from,
+					"to":   to,
+				}).Warn("circuit")
+			},
+		}
+	}
+
+	if outlierWindow > 0 {
+		p.Outliers = &httpproxyfailover.Outliers{
+			Window:             outlierWindow,
+			BaseEjectionTime:   outlierEjectionTime,
+			MaxEjectionTime:    outlierMaxEjectionTime,
+			MaxEjectionPercent: outlierMaxEjectionPercent,
+			OnEject: func(b string, ejected bool) {
+				log := logrus.WithField("via", b)
+				if ejected {
+					log.Warn("eject")
+					return
+				}
+				log.Info("uneject")
+			},
+		}
+	}
+
+	if retryBudget > 0 {
+		p.RetryBudget = &httpproxyfailover.RetryBudget{
+			Percent:      retryBudget,
+			MinPerSecond: retryBudgetMin,
+		}
+	}
+
+	if len(failFast) > 0 || len(markUnhealthy) > 0 {
+		c := httpproxyfailover.StatusClassifier{}
+		for _, code := range failFast {
+			c[code] = httpproxyfailover.FailFast
+		}
+		for _, code := range markUnhealthy {
+			c[code] = httpproxyfailover.MarkUnhealthy
+		}
+		p.Classify = c.Classify
+	}
+
+	switch errorResponse {
+	case "":
+	case "text":
+		p.WriteError = httpproxyfailover.WriteText
+	case "json":
+		p.WriteError = httpproxyfailover.WriteJSON
+	case "relay-last":
+		p.WriteError = httpproxyfailover.RelayLast
+	default:
+		logrus.WithField("error-response", errorResponse).Fatal("unknown error response")
+	}
+
+	if slowStart > 0 {
+		p.SlowStart = &httpproxyfailover.SlowStart{
+			Window: slowStart,
+		}
+	}
+
+	if sessionKey != "" {
+		p.Sessions = &httpproxyfailover.Sessions{
+			Key: sessionKey,
+			TTL: sessionTTL,
+		}
+	}
+
+	if proxyCA != "" {
+		b, err := ioutil.ReadFile(proxyCA)
+		if err != nil {
+			logrus.WithError(err).Fatal("failed to read proxy CA")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			logrus.WithField("file", proxyCA).Fatal("no certificate in proxy CA")
+		}
+		httpproxyfailover.ProxyTLS.RootCAs = pool
+	}
+
+	if proxyCert != "" {
+		cert, err := tls.LoadX509KeyPair(proxyCert, proxyKey)
+		if err != nil {
+			logrus.WithError(err).Fatal("failed to load proxy client certificate")
+		}
+		httpproxyfailover.ProxyTLS.Certificates = []tls.Certificate{cert}
+	}
+
+	var checks []httpproxyfailover.Check
+
 	if tlsHandshake {
-		p.Checks = append(p.Checks, httpproxyfailover.CheckTLSHandshake)
+		checks = append(checks, httpproxyfailover.CheckTLSHandshake)
 	}
 
 	if favicon {
-		p.Checks = append(p.Checks, httpproxyfailover.CheckFavicon)
+		checks = append(checks, httpproxyfailover.CheckFavicon)
 	}
 
 	if len(get) > 0 {
-		p.Checks = append(p.Checks, httpproxyfailover.CheckGET(get...))
+		checks = append(checks, httpproxyfailover.CheckGET(get...))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if healthInterval > 0 {
+		p.HealthCheck = &httpproxyfailover.HealthCheck{
+			Target:   healthTarget,
+			Checks:   checks,
+			Interval: healthInterval,
+			Timeout:  timeout,
+			Rise:     healthRise,
+			Fall:     healthFall,
+			OnChange: func(b string, healthy bool, err error) {
+				log := logrus.WithField("via", b)
+				if !healthy {
+					log.WithError(err).Warn("unhealthy")
+					return
+				}
+				log.Info("healthy")
+			},
+		}
+		go p.HealthCheck.Run(ctx)
+	} else {
+		p.Checks = checks
 	}
 
 	if err := p.EnableTemplates(); err != nil {
@@ -88,6 +318,7 @@ func main() {
 		"timeout":      timeout,
 		"tlsHandshake": tlsHandshake,
 		"favicon":      favicon,
+		"strategy":     strategy,
 	}).Info("start")
 
 	s := http.Server{
@@ -103,11 +334,66 @@ func main() {
 		}
 	}()
 
+	var sl net.Listener
+	if socksPort > 0 {
+		sl, err = net.Listen("tcp", fmt.Sprintf(":%d", socksPort))
+		if err != nil {
+			logrus.WithError(err).Fatal("failed to listen")
+		}
+
+		logrus.WithField("addr", sl.Addr()).Info("start socks")
+
+		socks := httpproxyfailover.SOCKS{
+			Proxy: &p,
+		}
+
+		go func() {
+			err := socks.Serve(sl)
+			select {
+			case <-ctx.Done():
+			default:
+				logrus.WithError(err).Fatal("failed to serve socks")
+			}
+		}()
+	}
+
 	<-c
 
+	cancel()
+	if sl != nil {
+		_ = sl.Close()
+	}
+
 	if err := s.Shutdown(context.Background()); err != nil {
 		logrus.WithError(err).Fatal("failed to shutdown")
 	}
 
 	logrus.Info("end")
 }
+
+func newSelector(strategy string, p *httpproxyfailover.Proxy) (httpproxyfailover.Selector, error) {
+	switch strategy {
+	case "in-order":
+		return httpproxyfailover.InOrder{}, nil
+	case "round-robin":
+		return &httpproxyfailover.RoundRobin{}, nil
+	case "random":
+		return httpproxyfailover.Random{}, nil
+	case "weighted":
+		return httpproxyfailover.WeightedRandom{}, nil
+	case "least-tunnels":
+		if p.Tunnels == nil {
+			p.Tunnels = &httpproxyfailover.Tunnels{}
+		}
+		return httpproxyfailover.LeastTunnels{Tunnels: p.Tunnels}, nil
+	case "least-latency":
+		if p.Latencies == nil {
+			p.Latencies = &httpproxyfailover.Latencies{}
+		}
+		return httpproxyfailover.PowerOfTwoChoices{Latencies: p.Latencies}, nil
+	case "consistent-hash":
+		return &httpproxyfailover.ConsistentHash{}, nil
+	default:
+		return nil, fmt.Errorf("unknown strategy: %s", strategy)
+	}
+}
@@ -0,0 +1,129 @@
+package httpproxyfailover
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Failure is a failed or skipped trial of a backend HTTP proxy.
+type Failure struct {
+	Backend Backend
+	Err     error
+}
+
+// ErrorWriter writes the response to a CONNECT request after all the trials fail.
+// The arguments are the response writer, the CONNECT request, the status code Proxy would respond with, the reason and
+// the failed or skipped trials in order.
+type ErrorWriter = func(w http.ResponseWriter, connect *http.Request, statusCode int, err error, failures []Failure)
+
+// WriteText is an ErrorWriter which responds with a plain text listing the failed trials.
+// Passwords in the backend HTTP proxy URLs are redacted.
+func WriteText(w http.ResponseWriter, _ *http.Request, statusCode int, err error, failures []Failure) {
+	var b strings.Builder
+	_, _ = fmt.Fprintln(&b, err)
+	for _, f := range failures {
+		_, _ = fmt.Fprintf(&b, "%s: %v\n", redact(f.Backend.URL), f.Err)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(statusCode)
+	_, _ = w.Write([]byte(b.String()))
+}
+
+// WriteJSON is an ErrorWriter which responds with a JSON object listing the failed trials.
+// Passwords in the backend HTTP proxy URLs are redacted.
+func WriteJSON(w http.ResponseWriter, _ *http.Request, statusCode int, err error, failures []Failure) {
+	type failure struct {
+		Backend    string `json:"backend"`
+		Tier       int    `json:"tier"`
+		Error      string `json:"error"`
+		StatusCode int    `json:"status_code,omitempty"`
+	}
+	body := struct {
+		Error    string    `json:"error"`
+		Failures []failure `json:"failures"`
+	}{
+		Error:    err.Error(),
+		Failures: make([]failure, len(failures)),
+	}
+	for i, f := range failures {
+		code, _ := StatusCode(f.Err)
+		body.Failures[i] = failure{
+			Backend:    redact(f.Backend.URL),
+			Tier:       f.Backend.Tier,
+			Error:      f.Err.Error(),
+			StatusCode: code,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	_ = json.NewEncoder(w).Encode(&body)
+}
+
+// RelayLast is an ErrorWriter which relays the status and the body of the last response from the backend HTTP proxies.
+// If none of the backend HTTP proxies responded, it responds with an empty body.
+func RelayLast(w http.ResponseWriter, connect *http.Request, statusCode int, err error, failures []Failure) {
+	Relay(func(failures []Failure) int {
+		return len(failures) - 1
+	})(w, connect, statusCode, err, failures)
+}
+
+// Relay returns an ErrorWriter which relays the status and the body of the response from the backend HTTP proxy of the
+// failed trial chosen by choose. choose returns the index of the chosen failure or a negative number to choose none.
+// Only failures with responses from the backend HTTP proxies are passed to choose.
+// If it chooses none, the ErrorWriter responds with an empty body.
+func Relay(choose func(failures []Failure) int) ErrorWriter {
+	return func(w http.ResponseWriter, _ *http.Request, statusCode int, _ error, failures []Failure) {
+		var responded []Failure
+		for _, f := range failures {
+			if _, ok := StatusCode(f.Err); ok {
+				responded = append(responded, f)
+			}
+		}
+
+		i := -1
+		if len(responded) > 0 {
+			i = choose(responded)
+		}
+		if i < 0 || i >= len(responded) {
+			http.Error(w, "", statusCode)
+			return
+		}
+
+		var e *unsuccessfulStatusError
+		_ = errors.As(responded[i].Err, &e)
+		for k, v := range e.header {
+			switch k {
+			case "Connection", "Content-Length", "Keep-Alive", "Proxy-Connection", "Trailer", "Transfer-Encoding", "Upgrade":
+				continue
+			case "Proxy-Status":
+				// The backend HTTP proxy is closer to the origin than Proxy.
+				w.Header()[k] = append(append([]string{}, v...), w.Header()[k]...)
+				continue
+			}
+			w.Header()[k] = v
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(e.body)))
+		w.WriteHeader(e.statusCode)
+		_, _ = w.Write(e.body)
+	}
+}
+
+// redact replaces the password in the backend HTTP proxy URL.
+func redact(backend string) string {
+	u, err := urlParse(backend)
+	if err != nil || u.User == nil {
+		return backend
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "xxxxx")
+	}
+	return u.String()
+}
@@ -0,0 +1,256 @@
+package httpproxyfailover
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+)
+
+// maxReplayBody is the maximum size of the body of a request Proxy keeps to send it again to the other backend HTTP
+// proxies.
+const maxReplayBody = 1 << 20
+
+// forward forwards a request in absolute-form (e.g. `GET http://example.com/ HTTP/1.1`) through the backend HTTP
+// proxies. An idempotent request is sent again to the next backend HTTP proxy if a trial fails before the response
+// headers. Other requests are sent to the next backend HTTP proxy only if Proxy fails to connect to the backend HTTP
+// proxy. Checks don't apply to forwarded requests, and neither Tunnels nor Latencies count them.
+func (p Proxy) forward(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		_ = r.Body.Close()
+	}()
+
+	backends, ok := p.backends(w, r)
+	if !ok {
+		return
+	}
+
+	body, err := readBody(r)
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+	if !body.replayable {
+		// It can't be sent to multiple backend HTTP proxies at once.
+		p.Race, p.HedgeDelay = 1, 0
+	}
+
+	t, failures, err := p.try(r, p.order(r, backends), func(ctx context.Context, b Backend) trial {
+		resp, sent, err := p.forwardOne(ctx, b.URL, r, body)
+		return trial{
+			backend: b,
+			resp:    resp,
+			err:     err,
+			fatal:   err != nil && sent && !body.replayable,
+		}
+	})
+	if err != nil {
+		p.fail(w, r, err, failures)
+		return
+	}
+	defer t.close()
+
+	if p.Sessions != nil {
+		p.Sessions.pin(r, t.backend.URL)
+	}
+
+	removeHopByHop(t.resp.Header)
+	for k, v := range t.resp.Header {
+		w.Header()[k] = v
+	}
+	w.Header().Add("Proxy-Status", p.proxyStatus(t.backend.URL, nil))
+	w.WriteHeader(t.resp.StatusCode)
+	read, _ := io.Copy(w, t.resp.Body)
+	p.OnDisconnect(read, body.size())
+}
+
+// forwardOne sends the request to the backend HTTP proxy and returns the response. It also reports whether it started
+// sending the request.
+func (p *Proxy) forwardOne(ctx context.Context, backend string, r *http.Request, body *body) (*http.Response, bool, error) {
+	if p.Timeout != 0 {
+		var cancel func()
+		ctx, cancel = context.WithTimeout(ctx, p.Timeout)
+		defer cancel()
+	}
+
+	u, err := urlParse(backend)
+	if err != nil {
+		return nil, false, err
+	}
+
+	conn, err := dial(ctx, u)
+	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return nil, false, err
+	}
+
+	stop := interrupt(ctx, conn)
+	if isSOCKS(u) {
+		if err := socks(ctx, conn, u, target(r.URL)); err != nil {
+			stop()
+			_ = conn.Close()
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			}
+			return nil, false, err
+		}
+	}
+	req := forwardReq(r, u.User, body.reader())
+	resp, err := roundTrip(conn, req, isSOCKS(u))
+	if stop() {
+		_ = conn.Close()
+		return nil, true, ctx.Err()
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, true, err
+	}
+	resp.Body = &connBody{ReadCloser: resp.Body, conn: conn}
+	return resp, true, nil
+}
+
+// roundTrip sends the request and reads the response. The request is in origin-form through a tunnel, otherwise in
+// absolute-form.
+func roundTrip(conn net.Conn, req *http.Request, tunnel bool) (*http.Response, error) {
+	var err error
+	if tunnel {
+		req.Header.Del("Proxy-Authorization")
+		err = req.Write(conn)
+	} else {
+		err = req.WriteProxy(conn)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return http.ReadResponse(bufio.NewReader(conn), req)
+}
+
+// target returns the host and port of the URL.
+func target(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
+
+func forwardReq(r *http.Request, userinfo *url.Userinfo, body io.Reader) *http.Request {
+	req := http.Request{
+		Method:        r.Method,
+		URL:           r.URL,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{},
+		ContentLength: r.ContentLength,
+		Host:          r.Host,
+		Close:         true,
+	}
+	if r.ContentLength != 0 {
+		req.Body = ioutil.NopCloser(body)
+	}
+	for k, v := range r.Header {
+		req.Header[k] = v
+	}
+	auth := req.Header.Get("Proxy-Authorization")
+	removeHopByHop(req.Header)
+	// Proxy-Authorization is passed through just like CONNECT requests unless the backend HTTP proxy has credentials.
+	if auth != "" {
+		req.Header.Set("Proxy-Authorization", auth)
+	}
+	if userinfo != nil {
+		req.Header.Set("Proxy-Authorization", fmt.Sprintf("Basic %s", base64.StdEncoding.EncodeToString([]byte(userinfo.String()))))
+	}
+	return &req
+}
+
+// removeHopByHop removes the hop-by-hop headers including the ones listed in Connection header.
+func removeHopByHop(h http.Header) {
+	for _, v := range h["Connection"] {
+		for _, k := range strings.Split(v, ",") {
+			if k = strings.TrimSpace(k); k != "" {
+				h.Del(k)
+			}
+		}
+	}
+	for _, k := range []string{"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization", "Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade"} {
+		h.Del(k)
+	}
+}
+
+// body is the body of a forwarded request.
+type body struct {
+	// replayable reports whether the body can be sent multiple times.
+	replayable bool
+
+	buf  []byte
+	rest io.Reader
+	read int64
+}
+
+// readBody reads the body of an idempotent request up to maxReplayBody so that it can be sent multiple times.
+func readBody(r *http.Request) (*body, error) {
+	if !idempotent(r) {
+		return &body{rest: r.Body}, nil
+	}
+
+	buf, err := ioutil.ReadAll(io.LimitReader(r.Body, maxReplayBody+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) > maxReplayBody {
+		return &body{rest: io.MultiReader(bytes.NewReader(buf), r.Body)}, nil
+	}
+	return &body{replayable: true, buf: buf}, nil
+}
+
+func (b *body) reader() io.Reader {
+	if b.replayable {
+		return bytes.NewReader(b.buf)
+	}
+	return b
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	n, err := b.rest.Read(p)
+	b.read += int64(n)
+	return n, err
+}
+
+// size returns the number of bytes sent to the backend HTTP proxy.
+func (b *body) size() int64 {
+	if b.replayable {
+		return int64(len(b.buf))
+	}
+	return b.read
+}
+
+func idempotent(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	_, ok := r.Header[textproto.CanonicalMIMEHeaderKey("Idempotency-Key")]
+	return ok
+}
+
+// connBody closes the connection to the backend HTTP proxy along with the response body.
+type connBody struct {
+	io.ReadCloser
+	conn net.Conn
+}
+
+func (b *connBody) Close() error {
+	err := b.ReadCloser.Close()
+	_ = b.conn.Close()
+	return err
+}
@@ -0,0 +1,36 @@
+package httpproxyfailover
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRemoveHopByHop(t *testing.T) {
+	h := http.Header{
+		"Connection":          {"X-Hop, Keep-Alive"},
+		"Keep-Alive":          {"timeout=5"},
+		"Proxy-Authorization": {"Basic Zm9vOmJhcg=="},
+		"Proxy-Connection":    {"keep-alive"},
+		"X-Hop":               {"hop"},
+		"X-End-To-End":        {"end-to-end"},
+	}
+	removeHopByHop(h)
+	assert.Equal(t, http.Header{
+		"X-End-To-End": {"end-to-end"},
+	}, h)
+}
+
+func TestIdempotent(t *testing.T) {
+	for _, m := range []string{http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete} {
+		assert.True(t, idempotent(httptest.NewRequest(m, "http://example.com/", nil)), m)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "http://example.com/", nil)
+	assert.False(t, idempotent(r))
+
+	r.Header.Set("Idempotency-Key", "foo")
+	assert.True(t, idempotent(r))
+}
@@ -0,0 +1,212 @@
+package httpproxyfailover
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// ErrUnhealthy is the error for a backend HTTP proxy skipped by HealthCheck.
+var ErrUnhealthy = errors.New("unhealthy")
+
+// HealthCheck checks backend HTTP proxies in background.
+// A backend HTTP proxy is checked once Proxy finds it applicable for a CONNECT request. It's considered healthy until
+// it fails Fall times in a row, and then it's considered unhealthy until it succeeds Rise times in a row.
+// Proxy skips unhealthy backend HTTP proxies without trials.
+type HealthCheck struct {
+	// Target is the host and port of the CONNECT requests for checks (e.g. `example.com:443`).
+	Target string
+
+	// Checks are further checks on each backend. See Proxy.Checks.
+	Checks []Check
+
+	// Interval is the interval between checks. If it's 0, 10 seconds is used.
+	Interval time.Duration
+
+	// Timeout sets the deadline of each check. If it's 0, Interval is used so that a non-responsive backend HTTP proxy
+	// doesn't hold the checks of the others.
+	Timeout time.Duration
+
+	// Rise is the number of consecutive successes to be considered healthy. If it's 0, 2 is used.
+	Rise int
+
+	// Fall is the number of consecutive failures to be considered unhealthy. If it's 0, 3 is used.
+	Fall int
+
+	// OnChange is signaled after a backend HTTP proxy changes its health if provided.
+	OnChange func(backend string, healthy bool, err error)
+
+	mu     sync.Mutex
+	states map[string]*health
+}
+
+type health struct {
+	unhealthy bool
+	count     int
+	lastSeen  time.Time
+}
+
+// Healthy reports whether the backend is considered healthy.
+func (h *HealthCheck) Healthy(backend string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.states[backend]
+	return !ok || !s.unhealthy
+}
+
+// Run checks the backends every Interval until ctx is done.
+func (h *HealthCheck) Run(ctx context.Context) {
+	t := time.NewTicker(h.interval())
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			h.checkAll(ctx)
+		}
+	}
+}
+
+// watch starts checking the backend if it's not checked yet, and reports whether it's healthy.
+func (h *HealthCheck) watch(backend string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.states == nil {
+		h.states = map[string]*health{}
+	}
+	s, ok := h.states[backend]
+	if !ok {
+		s = &health{}
+		h.states[backend] = s
+	}
+	s.lastSeen = time.Now()
+	return !s.unhealthy
+}
+
+func (h *HealthCheck) checkAll(ctx context.Context) {
+	// Backends which haven't been applicable for a while are no longer checked.
+	forget := time.Now().Add(-10 * h.interval())
+
+	h.mu.Lock()
+	backends := make([]string, 0, len(h.states))
+	for b, s := range h.states {
+		if s.lastSeen.Before(forget) {
+			delete(h.states, b)
+			continue
+		}
+		backends = append(backends, b)
+	}
+	h.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, b := range backends {
+		wg.Add(1)
+		go func(b string) {
+			defer wg.Done()
+			h.record(b, h.check(ctx, b))
+		}(b)
+	}
+	wg.Wait()
+}
+
+func (h *HealthCheck) check(ctx context.Context, backend string) error {
+	timeout := h.Timeout
+	if timeout == 0 {
+		timeout = h.interval()
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	connect := (&http.Request{
+		Method:     http.MethodConnect,
+		URL:        &url.URL{Host: h.Target},
+		Host:       h.Target,
+		RequestURI: h.Target,
+		Header:     http.Header{},
+	}).WithContext(ctx)
+
+	inbound, _, err := inbound(ctx, connect, backend)
+	if err != nil {
+		return err
+	}
+	_ = inbound.Close()
+
+	for _, c := range h.Checks {
+		if err := c(ctx, connect, backend); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (h *HealthCheck) record(backend string, err error) {
+	h.mu.Lock()
+	s, ok := h.states[backend]
+	if !ok {
+		h.mu.Unlock()
+		return
+	}
+	var changed bool
+	switch {
+	case err == nil && s.unhealthy:
+		s.count++
+		if s.count >= h.rise() {
+			s.unhealthy, s.count, changed = false, 0, true
+		}
+	case err != nil && !s.unhealthy:
+		s.count++
+		if s.count >= h.fall() {
+			s.unhealthy, s.count, changed = true, 0, true
+		}
+	default:
+		s.count = 0
+	}
+	healthy := !s.unhealthy
+	h.mu.Unlock()
+
+	if changed && h.OnChange != nil {
+		h.OnChange(backend, healthy, err)
+	}
+}
+
+// fail marks the backend unhealthy regardless of Fall.
+func (h *HealthCheck) fail(backend string, err error) {
+	h.mu.Lock()
+	s, ok := h.states[backend]
+	if !ok || s.unhealthy {
+		h.mu.Unlock()
+		return
+	}
+	s.unhealthy, s.count = true, 0
+	h.mu.Unlock()
+
+	if h.OnChange != nil {
+		h.OnChange(backend, false, err)
+	}
+}
+
+func (h *HealthCheck) interval() time.Duration {
+	if h.Interval == 0 {
+		return 10 * time.Second
+	}
+	return h.Interval
+}
+
+func (h *HealthCheck) rise() int {
+	if h.Rise == 0 {
+		return 2
+	}
+	return h.Rise
+}
+
+func (h *HealthCheck) fall() int {
+	if h.Fall == 0 {
+		return 3
+	}
+	return h.Fall
+}
@@ -0,0 +1,93 @@
+package httpproxyfailover
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthCheck(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer origin.Close()
+	originURL, err := url.Parse(origin.URL)
+	assert.NoError(t, err)
+
+	status := http.StatusOK
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodConnect, r.Method)
+		assert.Equal(t, originURL.Host, r.Host)
+		w.Header().Set("Connection", "close")
+		w.WriteHeader(status)
+	}))
+	defer backend.Close()
+
+	type change struct {
+		backend string
+		healthy bool
+	}
+	var changes []change
+	h := HealthCheck{
+		Target: originURL.Host,
+		Rise:   2,
+		Fall:   1,
+		OnChange: func(backend string, healthy bool, err error) {
+			changes = append(changes, change{backend: backend, healthy: healthy})
+		},
+	}
+	ctx := context.Background()
+
+	// Backends are checked once they're watched.
+	assert.True(t, h.watch(backend.URL))
+	h.checkAll(ctx)
+	assert.True(t, h.Healthy(backend.URL))
+
+	status = http.StatusServiceUnavailable
+	h.checkAll(ctx)
+	assert.False(t, h.Healthy(backend.URL))
+	assert.False(t, h.watch(backend.URL))
+
+	status = http.StatusOK
+	h.checkAll(ctx)
+	assert.False(t, h.Healthy(backend.URL))
+	h.checkAll(ctx)
+	assert.True(t, h.Healthy(backend.URL))
+
+	assert.Equal(t, []change{
+		{backend: backend.URL, healthy: false},
+		{backend: backend.URL, healthy: true},
+	}, changes)
+
+	// Backends are forgotten once they're no longer watched.
+	h.states[backend.URL].lastSeen = time.Now().Add(-time.Hour)
+	h.checkAll(ctx)
+	assert.Empty(t, h.states)
+}
+
+func TestHealthCheck_nonResponsive(t *testing.T) {
+	// It accepts TCP connections but never responds to CONNECT requests.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer func() {
+		assert.NoError(t, l.Close())
+	}()
+	backend := "http://" + l.Addr().String()
+
+	h := HealthCheck{
+		Target:   "example.com:443",
+		Interval: 50 * time.Millisecond,
+		Fall:     1,
+	}
+
+	// Without Timeout, the check is bounded by Interval.
+	assert.True(t, h.watch(backend))
+	start := time.Now()
+	h.checkAll(context.Background())
+	assert.True(t, time.Since(start) < time.Second)
+	assert.False(t, h.Healthy(backend))
+}
@@ -0,0 +1,159 @@
+package httpproxyfailover
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"sync"
+)
+
+// ProxyTLS is the base TLS configuration to connect to backend HTTPS proxies.
+// A backend HTTPS proxy can override it by the query parameters of its URL: `ca` for the path to a PEM file of CA
+// certificates to verify the proxy, `cert` and `key` for the paths to PEM files of a client certificate and its private
+// key, and `sni` for the server name to send and verify instead of the host of the URL
+// (e.g. `https://proxy.example.com:443?ca=/etc/ca.pem&cert=/etc/client.pem&key=/etc/client-key.pem`).
+var ProxyTLS tls.Config
+
+var proxyTLSParams = map[string]bool{
+	"ca":   true,
+	"cert": true,
+	"key":  true,
+	"sni":  true,
+}
+
+// tlsFiles caches the certificates loaded for the query parameters of backend HTTPS proxies.
+var tlsFiles = struct {
+	sync.Mutex
+	loaded map[string]*tlsFile
+}{}
+
+type tlsFile struct {
+	rootCAs *x509.CertPool
+	certs   []tls.Certificate
+}
+
+// validateTLSParams checks the query parameters of a backend HTTPS proxy.
+func validateTLSParams(q url.Values) error {
+	for k := range q {
+		if !proxyTLSParams[k] {
+			return fmt.Errorf("unknown parameter: %s", k)
+		}
+	}
+	if (q.Get("cert") == "") != (q.Get("key") == "") {
+		return errors.New("cert and key must be given together")
+	}
+	return nil
+}
+
+// proxyTLSConfig returns the TLS configuration for the backend HTTPS proxy.
+func proxyTLSConfig(u *url.URL) (*tls.Config, error) {
+	q := u.Query()
+	if err := validateTLSParams(q); err != nil {
+		return nil, err
+	}
+
+	config := ProxyTLS.Clone()
+	config.ServerName = u.Hostname()
+	if sni := q.Get("sni"); sni != "" {
+		config.ServerName = sni
+	}
+
+	if q.Get("ca") == "" && q.Get("cert") == "" {
+		return config, nil
+	}
+
+	f, err := loadTLSFile(q.Get("ca"), q.Get("cert"), q.Get("key"))
+	if err != nil {
+		return nil, err
+	}
+	if f.rootCAs != nil {
+		config.RootCAs = f.rootCAs
+	}
+	if f.certs != nil {
+		config.Certificates = f.certs
+	}
+	return config, nil
+}
+
+func loadTLSFile(ca, cert, key string) (*tlsFile, error) {
+	k := ca + "\x00" + cert + "\x00" + key
+
+	tlsFiles.Lock()
+	defer tlsFiles.Unlock()
+	if f, ok := tlsFiles.loaded[k]; ok {
+		return f, nil
+	}
+
+	var f tlsFile
+	if ca != "" {
+		b, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+		f.rootCAs = x509.NewCertPool()
+		if !f.rootCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificate in %s", ca)
+		}
+	}
+	if cert != "" {
+		c, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+		f.certs = []tls.Certificate{c}
+	}
+
+	if tlsFiles.loaded == nil {
+		tlsFiles.loaded = map[string]*tlsFile{}
+	}
+	tlsFiles.loaded[k] = &f
+	return &f, nil
+}
+
+// address returns the host and port of the backend proxy. The port defaults to 443 for HTTPS and to 1080 for SOCKS.
+func address(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	switch {
+	case u.Scheme == "https":
+		return net.JoinHostPort(u.Hostname(), "443")
+	case isSOCKS(u):
+		return net.JoinHostPort(u.Hostname(), "1080")
+	default:
+		return u.Host
+	}
+}
+
+// dial connects to the backend proxy. For a backend HTTPS proxy, it also establishes TLS on the connection.
+func dial(ctx context.Context, u *url.URL) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", address(u))
+	if err != nil || u.Scheme != "https" {
+		return conn, err
+	}
+
+	config, err := proxyTLSConfig(u)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	tlsConn := tls.Client(conn, config)
+	stop := interrupt(ctx, conn)
+	err = tlsConn.Handshake()
+	if stop() {
+		_ = conn.Close()
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
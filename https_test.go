@@ -0,0 +1,200 @@
+package httpproxyfailover
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestProxyTLSConfig(t *testing.T) {
+	t.Run("default", func(t *testing.T) {
+		c, err := proxyTLSConfig(&url.URL{Scheme: "https", Host: "proxy.example.com:8443"})
+		assert.NoError(t, err)
+		assert.Equal(t, "proxy.example.com", c.ServerName)
+		assert.Nil(t, c.RootCAs)
+		assert.Empty(t, c.Certificates)
+	})
+
+	t.Run("sni", func(t *testing.T) {
+		c, err := proxyTLSConfig(&url.URL{Scheme: "https", Host: "127.0.0.1:8443", RawQuery: "sni=proxy.example.com"})
+		assert.NoError(t, err)
+		assert.Equal(t, "proxy.example.com", c.ServerName)
+	})
+
+	t.Run("unknown parameter", func(t *testing.T) {
+		_, err := proxyTLSConfig(&url.URL{Scheme: "https", Host: "127.0.0.1:8443", RawQuery: "foo=bar"})
+		assert.Error(t, err)
+	})
+
+	t.Run("cert without key", func(t *testing.T) {
+		_, err := proxyTLSConfig(&url.URL{Scheme: "https", Host: "127.0.0.1:8443", RawQuery: "cert=client.pem"})
+		assert.Error(t, err)
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		_, err := proxyTLSConfig(&url.URL{Scheme: "https", Host: "127.0.0.1:8443", RawQuery: "ca=/nonexistent.pem"})
+		assert.Error(t, err)
+	})
+}
+
+func TestInbound_https(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpproxyfailover")
+	assert.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(dir))
+	}()
+
+	serverCert, serverKey, _ := testCert(t, dir, "server", "proxy.test")
+	clientCert, clientKey, client := testCert(t, dir, "client")
+
+	origin := echoServer(t)
+	defer func() {
+		assert.NoError(t, origin.Close())
+	}()
+
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, r.Body.Close())
+		if r.Method != http.MethodConnect {
+			_, _ = fmt.Fprintf(w, "%s %s", r.Method, r.URL)
+			return
+		}
+
+		inbound, err := net.Dial("tcp", r.URL.Host)
+		assert.NoError(t, err)
+
+		w.Header().Set("Content-Length", "0")
+		w.WriteHeader(http.StatusOK)
+		h, ok := w.(http.Hijacker)
+		assert.True(t, ok)
+
+		outbound, _, err := h.Hijack()
+		assert.NoError(t, err)
+
+		pipe(inbound, outbound)
+	}))
+	cert, err := tls.LoadX509KeyPair(serverCert, serverKey)
+	assert.NoError(t, err)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(client)
+	backend.TLS = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	backend.Config.ErrorLog = nil
+	backend.StartTLS()
+	defer backend.Close()
+
+	connect := httptest.NewRequest(http.MethodConnect, origin.Addr().String(), nil)
+	b := fmt.Sprintf("https://%s?%s", backend.Listener.Addr(), url.Values{
+		"ca":   {serverCert},
+		"cert": {clientCert},
+		"key":  {clientKey},
+		"sni":  {"proxy.test"},
+	}.Encode())
+
+	t.Run("OK", func(t *testing.T) {
+		conn, resp, err := inbound(context.Background(), connect, b)
+		assert.NoError(t, err)
+		defer func() {
+			assert.NoError(t, conn.Close())
+		}()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		_, err = conn.Write([]byte("ping"))
+		assert.NoError(t, err)
+		buf := make([]byte, 4)
+		_, err = io.ReadFull(conn, buf)
+		assert.NoError(t, err)
+		assert.Equal(t, "ping", string(buf))
+	})
+
+	t.Run("unknown authority", func(t *testing.T) {
+		b := fmt.Sprintf("https://%s?%s", backend.Listener.Addr(), url.Values{
+			"cert": {clientCert},
+			"key":  {clientKey},
+			"sni":  {"proxy.test"},
+		}.Encode())
+		_, _, err := inbound(context.Background(), connect, b)
+		assert.Error(t, err)
+	})
+
+	t.Run("no client certificate", func(t *testing.T) {
+		b := fmt.Sprintf("https://%s?%s", backend.Listener.Addr(), url.Values{
+			"ca":  {serverCert},
+			"sni": {"proxy.test"},
+		}.Encode())
+		_, _, err := inbound(context.Background(), connect, b)
+		assert.Error(t, err)
+	})
+
+	t.Run("forward", func(t *testing.T) {
+		var c MockCallback
+		c.On("OnConnect", mock.AnythingOfType("*http.Request"), b, nil).Return()
+		c.On("OnDisconnect", int64(26), int64(0)).Return()
+		defer c.AssertExpectations(t)
+
+		h := Proxy{
+			Backends:     []string{b},
+			OnConnect:    c.OnConnect,
+			OnDisconnect: c.OnDisconnect,
+		}
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "http://example.com/foo", nil)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "GET http://example.com/foo", w.Body.String())
+	})
+}
+
+// testCert generates a self-signed certificate and its private key in dir.
+func testCert(t *testing.T, dir, name string, hosts ...string) (string, string, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	tmpl := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              hosts,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, key.Public(), key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	certFile := filepath.Join(dir, name+".pem")
+	keyFile := filepath.Join(dir, name+"-key.pem")
+	assert.NoError(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certFile, keyFile, cert
+}
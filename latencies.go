@@ -0,0 +1,67 @@
+package httpproxyfailover
+
+import (
+	"sync"
+	"time"
+)
+
+// Latencies keeps exponentially weighted moving averages of CONNECT round-trip latencies of each backend HTTP proxy.
+type Latencies struct {
+	// Decay is the weight of a new sample between 0 and 1. If it's 0, 0.3 is used.
+	Decay float64
+
+	// Penalty is the sample recorded for a failed CONNECT request so that a failing backend HTTP proxy doesn't look
+	// like an unmeasured one forever. If it's 0, 10 seconds is used.
+	Penalty time.Duration
+
+	mu       sync.Mutex
+	averages map[string]time.Duration
+}
+
+// Average returns the moving average of the backend's latencies. The second return value is false if the backend
+// has no samples yet.
+func (l *Latencies) Average(backend string) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	a, ok := l.averages[backend]
+	return a, ok
+}
+
+// Averages returns a snapshot of the moving averages keyed by backends.
+func (l *Latencies) Averages() map[string]time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ret := make(map[string]time.Duration, len(l.averages))
+	for b, a := range l.averages {
+		ret[b] = a
+	}
+	return ret
+}
+
+// fail records the penalty for a failed CONNECT request.
+func (l *Latencies) fail(backend string) {
+	penalty := l.Penalty
+	if penalty == 0 {
+		penalty = 10 * time.Second
+	}
+	l.record(backend, penalty)
+}
+
+func (l *Latencies) record(backend string, latency time.Duration) {
+	decay := l.Decay
+	if decay == 0 {
+		decay = 0.3
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.averages == nil {
+		l.averages = map[string]time.Duration{}
+	}
+	a, ok := l.averages[backend]
+	if !ok {
+		l.averages[backend] = latency
+		return
+	}
+	l.averages[backend] = time.Duration(decay*float64(latency) + (1-decay)*float64(a))
+}
@@ -0,0 +1,36 @@
+package httpproxyfailover
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLatencies(t *testing.T) {
+	l := Latencies{Decay: 0.5}
+	_, ok := l.Average("a")
+	assert.False(t, ok)
+
+	l.record("a", 100*time.Millisecond)
+	a, ok := l.Average("a")
+	assert.True(t, ok)
+	assert.Equal(t, 100*time.Millisecond, a)
+
+	l.record("a", 200*time.Millisecond)
+	a, ok = l.Average("a")
+	assert.True(t, ok)
+	assert.Equal(t, 150*time.Millisecond, a)
+
+	l.record("b", time.Second)
+	assert.Equal(t, map[string]time.Duration{
+		"a": 150 * time.Millisecond,
+		"b": time.Second,
+	}, l.Averages())
+
+	l.Penalty = 5 * time.Second
+	l.fail("c")
+	a, ok = l.Average("c")
+	assert.True(t, ok)
+	assert.Equal(t, 5*time.Second, a)
+}
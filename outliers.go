@@ -0,0 +1,240 @@
+package httpproxyfailover
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+// ErrEjected is the error for a backend HTTP proxy skipped by Outliers.
+var ErrEjected = errors.New("ejected")
+
+// Outliers ejects backend HTTP proxies whose failure rates are significantly worse than the others'.
+// A backend HTTP proxy is ejected if its failure rate in the window exceeds the mean failure rate of the backend HTTP
+// proxies by StdevFactor times the standard deviation and by MinGap. Proxy skips ejected backend HTTP proxies without trials.
+type Outliers struct {
+	// Window is the number of the latest trials to calculate the failure rate of a backend. If it's 0, 100 is used.
+	Window int
+
+	// MinTrials is the number of trials in the window for a backend to be evaluated. If it's 0, 10 is used.
+	MinTrials int
+
+	// MinBackends is the number of evaluated backends to eject any of them. If it's 0, 3 is used.
+	MinBackends int
+
+	// StdevFactor is the factor of the standard deviation of the failure rates. If it's 0, 1.9 is used.
+	StdevFactor float64
+
+	// MinGap is the minimum difference between the failure rate of a backend and the mean failure rate for the backend
+	// to be ejected. It keeps slightly worse backends in a healthy pool. If it's 0, 0.1 is used.
+	MinGap float64
+
+	// BaseEjectionTime is the duration of the first ejection. A backend is ejected for the duration multiplied by the
+	// number of ejections so far, up to MaxEjectionTime. If it's 0, 30 seconds is used.
+	BaseEjectionTime time.Duration
+
+	// MaxEjectionTime is the maximum duration of an ejection. It keeps a backend with occasional bad spells from being
+	// ejected for hours. If it's 0, 300 seconds is used.
+	MaxEjectionTime time.Duration
+
+	// MaxEjectionPercent is the maximum percentage of backends to be ejected at once. Still, a single backend can be
+	// ejected regardless of the percentage. If it's 0, 10 is used.
+	MaxEjectionPercent int
+
+	// OnEject is signaled after a backend HTTP proxy is ejected or gets back if provided.
+	OnEject func(backend string, ejected bool)
+
+	mu       sync.Mutex
+	outliers map[string]*outlier
+}
+
+type outlier struct {
+	results   []bool
+	next      int
+	failures  int
+	ejections int
+	until     time.Time
+}
+
+func (o *outlier) rate() float64 {
+	return float64(o.failures) / float64(len(o.results))
+}
+
+// Ejected reports whether the backend is ejected.
+func (o *Outliers) Ejected(backend string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	b, ok := o.outliers[backend]
+	return ok && time.Now().Before(b.until)
+}
+
+// allow reports whether the backend isn't ejected.
+func (o *Outliers) allow(backend string) bool {
+	o.mu.Lock()
+	b, ok := o.outliers[backend]
+	if !ok || b.until.IsZero() {
+		o.mu.Unlock()
+		return true
+	}
+	if time.Now().Before(b.until) {
+		o.mu.Unlock()
+		return false
+	}
+	// It's back with a fresh window.
+	b.results, b.next, b.failures = b.results[:0], 0, 0
+	b.until = time.Time{}
+	o.mu.Unlock()
+
+	o.changed(backend, false)
+	return true
+}
+
+func (o *Outliers) record(backend string, err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+
+	o.mu.Lock()
+	if o.outliers == nil {
+		o.outliers = map[string]*outlier{}
+	}
+	b, ok := o.outliers[backend]
+	if !ok {
+		b = &outlier{}
+		o.outliers[backend] = b
+	}
+
+	failed := err != nil
+	if len(b.results) < o.window() {
+		b.results = append(b.results, failed)
+	} else {
+		if b.results[b.next] {
+			b.failures--
+		}
+		b.results[b.next] = failed
+		b.next = (b.next + 1) % len(b.results)
+	}
+	if failed {
+		b.failures++
+	}
+
+	ejected := failed && o.outlier(b)
+	if ejected {
+		b.ejections++
+		d := time.Duration(b.ejections) * o.baseEjectionTime()
+		if max := o.maxEjectionTime(); d > max {
+			d = max
+		}
+		b.until = time.Now().Add(d)
+	}
+	o.mu.Unlock()
+
+	if ejected {
+		o.changed(backend, true)
+	}
+}
+
+// outlier reports whether the backend should be ejected. o.mu has to be locked.
+func (o *Outliers) outlier(b *outlier) bool {
+	if !b.until.IsZero() || len(b.results) < o.minTrials() {
+		return false
+	}
+
+	now := time.Now()
+	var rates []float64
+	var ejected int
+	for _, c := range o.outliers {
+		if now.Before(c.until) {
+			ejected++
+			continue
+		}
+		if len(c.results) < o.minTrials() {
+			continue
+		}
+		rates = append(rates, c.rate())
+	}
+	if len(rates) < o.minBackends() {
+		return false
+	}
+	if ejected > 0 && (ejected+1)*100 > o.maxEjectionPercent()*len(o.outliers) {
+		return false
+	}
+
+	var mean float64
+	for _, r := range rates {
+		mean += r
+	}
+	mean /= float64(len(rates))
+
+	var variance float64
+	for _, r := range rates {
+		variance += (r - mean) * (r - mean)
+	}
+	stdev := math.Sqrt(variance / float64(len(rates)))
+
+	return b.rate() > mean+o.stdevFactor()*stdev && b.rate()-mean >= o.minGap()
+}
+
+func (o *Outliers) changed(backend string, ejected bool) {
+	if o.OnEject != nil {
+		o.OnEject(backend, ejected)
+	}
+}
+
+func (o *Outliers) window() int {
+	if o.Window == 0 {
+		return 100
+	}
+	return o.Window
+}
+
+func (o *Outliers) minTrials() int {
+	if o.MinTrials == 0 {
+		return 10
+	}
+	return o.MinTrials
+}
+
+func (o *Outliers) minBackends() int {
+	if o.MinBackends == 0 {
+		return 3
+	}
+	return o.MinBackends
+}
+
+func (o *Outliers) stdevFactor() float64 {
+	if o.StdevFactor == 0 {
+		return 1.9
+	}
+	return o.StdevFactor
+}
+
+func (o *Outliers) minGap() float64 {
+	if o.MinGap == 0 {
+		return 0.1
+	}
+	return o.MinGap
+}
+
+func (o *Outliers) baseEjectionTime() time.Duration {
+	if o.BaseEjectionTime == 0 {
+		return 30 * time.Second
+	}
+	return o.BaseEjectionTime
+}
+
+func (o *Outliers) maxEjectionTime() time.Duration {
+	if o.MaxEjectionTime == 0 {
+		return 300 * time.Second
+	}
+	return o.MaxEjectionTime
+}
+
+func (o *Outliers) maxEjectionPercent() int {
+	if o.MaxEjectionPercent == 0 {
+		return 10
+	}
+	return o.MaxEjectionPercent
+}
@@ -0,0 +1,109 @@
+package httpproxyfailover
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutliers(t *testing.T) {
+	type change struct {
+		backend string
+		ejected bool
+	}
+	var changes []change
+	o := Outliers{
+		Window:           10,
+		MinTrials:        5,
+		StdevFactor:      1,
+		BaseEjectionTime: 10 * time.Millisecond,
+		OnEject: func(backend string, ejected bool) {
+			changes = append(changes, change{backend: backend, ejected: ejected})
+		},
+	}
+	errFailed := errors.New("failed")
+
+	for _, b := range []string{"a", "b", "c", "d"} {
+		o.record(b, errFailed)
+		for i := 0; i < 5; i++ {
+			o.record(b, nil)
+		}
+		assert.False(t, o.Ejected(b))
+	}
+
+	// Not enough trials to be evaluated.
+	for i := 0; i < 4; i++ {
+		o.record("e", errFailed)
+	}
+	assert.False(t, o.Ejected("e"))
+
+	o.record("e", errFailed)
+	assert.True(t, o.Ejected("e"))
+	assert.False(t, o.allow("e"))
+
+	// Another one isn't ejected at once because of MaxEjectionPercent.
+	for i := 0; i < 10; i++ {
+		o.record("d", errFailed)
+	}
+	assert.False(t, o.Ejected("d"))
+
+	// Cancellation doesn't count.
+	for i := 0; i < 10; i++ {
+		o.record("f", context.Canceled)
+	}
+	assert.NotContains(t, o.outliers, "f")
+
+	// It gets back with a fresh window.
+	time.Sleep(10 * time.Millisecond)
+	assert.True(t, o.allow("e"))
+	assert.False(t, o.Ejected("e"))
+
+	// The ejection time grows.
+	for i := 0; i < 5; i++ {
+		o.record("e", errFailed)
+	}
+	assert.True(t, o.Ejected("e"))
+	time.Sleep(10 * time.Millisecond)
+	assert.False(t, o.allow("e"))
+	time.Sleep(10 * time.Millisecond)
+	assert.True(t, o.allow("e"))
+
+	// The ejection time doesn't grow beyond MaxEjectionTime.
+	o.MaxEjectionTime = 20 * time.Millisecond
+	for i := 0; i < 5; i++ {
+		o.record("e", errFailed)
+	}
+	assert.True(t, o.Ejected("e"))
+	time.Sleep(20 * time.Millisecond)
+	assert.True(t, o.allow("e"))
+
+	assert.Equal(t, []change{
+		{backend: "e", ejected: true},
+		{backend: "e", ejected: false},
+		{backend: "e", ejected: true},
+		{backend: "e", ejected: false},
+		{backend: "e", ejected: true},
+		{backend: "e", ejected: false},
+	}, changes)
+}
+
+func TestOutliers_healthy(t *testing.T) {
+	errFailed := errors.New("failed")
+
+	// Failure rates of 0, 0 and 0.01 aren't significantly different even with a small StdevFactor.
+	for _, o := range []*Outliers{{}, {StdevFactor: 1}} {
+		for _, b := range []string{"a", "b"} {
+			for i := 0; i < 100; i++ {
+				o.record(b, nil)
+			}
+		}
+		for i := 0; i < 99; i++ {
+			o.record("c", nil)
+		}
+		o.record("c", errFailed)
+		assert.False(t, o.Ejected("c"))
+	}
+}
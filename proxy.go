@@ -11,9 +11,12 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/url"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -25,19 +28,107 @@ import (
 type Proxy struct {
 	// Backends hold backend HTTP proxies. Proxy tries backend HTTP proxies in order of the slice and use the first one
 	// that responds with a successful status code (2XX).
+	// A backend can also be a SOCKS5 proxy with `socks5://` or `socks5h://` scheme. With `socks5://`, the host name of
+	// the target is resolved locally. With `socks5h://`, it's resolved by the SOCKS5 proxy.
+	// Likewise, a backend can be a SOCKS4 proxy with `socks4://` or `socks4a://` scheme. The username is sent as the
+	// user ID.
+	// A backend can also be an HTTPS proxy with `https://` scheme. See ProxyTLS for its TLS configuration.
 	Backends       []string
-	parsedBackends []*uritemplate.Template
+	parsedBackends []template
+
+	// Selector reorders the applicable backends for each CONNECT request if provided. Otherwise, Proxy tries them in
+	// order of Backends.
+	Selector Selector
+
+	// Tiers hold selectors for each tier of backends. Proxy tries all the applicable backends in a lower tier before
+	// the ones in a higher tier. The backends in a tier are reordered by the selector for the tier if provided,
+	// otherwise by Selector. Neither Sessions, Race nor HedgeDelay lets a backend jump ahead of a lower tier.
+	Tiers map[int]Selector
+
+	// Tunnels counts live tunnels through each backend HTTP proxy if provided. Forwarded requests in absolute-form don't
+	// count.
+	Tunnels *Tunnels
+
+	// Breakers skip backend HTTP proxies with open circuits without trials if provided.
+	Breakers *Breakers
+
+	// HealthCheck checks backend HTTP proxies in background and skips unhealthy ones without trials if provided.
+	// HealthCheck.Run has to be running.
+	HealthCheck *HealthCheck
+
+	// Outliers skip backend HTTP proxies with significantly high failure rates without trials if provided.
+	Outliers *Outliers
+
+	// SlowStart ramps up the share of newly added or recovered backend HTTP proxies if provided.
+	SlowStart *SlowStart
+
+	// Latencies records CONNECT round-trip latencies of each backend HTTP proxy if provided. Forwarded requests in
+	// absolute-form don't count.
+	Latencies *Latencies
+
+	// Sessions pins sessions to backend HTTP proxies if provided. Proxy tries the pinned backend first.
+	Sessions *Sessions
 
 	// Timeout sets the deadline of trial of each backend HTTP proxy if provided.
 	Timeout time.Duration
 
+	// Deadline sets the deadline of the whole trials for a CONNECT request if provided.
+	Deadline time.Duration
+
+	// MaxAttempts is the maximum number of trials for a CONNECT request if provided.
+	// Proxy responds with 504 Gateway Timeout if it runs out of Deadline, or with 503 Service Unavailable if it runs
+	// out of MaxAttempts, before any trial succeeds.
+	MaxAttempts int
+
+	// Retries is the number of times Proxy tries the applicable backends again after all of them fail.
+	Retries int
+
+	// RetryBackoff is the base delay before a retry. The delay doubles for each retry and is randomized between the
+	// half and the full of it. If it's 0, 100 milliseconds is used.
+	RetryBackoff time.Duration
+
+	// MaxRetryBackoff caps the delay before a retry. If it's 0, 10 seconds is used.
+	MaxRetryBackoff time.Duration
+
+	// RetryBudget caps trials beyond the first one for each CONNECT request if provided.
+	// Proxy responds with 503 Service Unavailable once it runs out of the budget.
+	RetryBudget *RetryBudget
+
+	// Race is the number of backend HTTP proxies Proxy tries at once if provided. The first one that succeeds wins and
+	// the others are canceled and closed. Whenever a trial fails, Proxy tries the next backend HTTP proxy.
+	Race int
+
+	// HedgeDelay is the delay after which Proxy starts trying the next backend HTTP proxy while the ongoing trials keep
+	// going if provided. Whichever succeeds first wins and the others are canceled and closed.
+	HedgeDelay time.Duration
+
 	// Checks are further checks on each backend. A backend is considered available if not only it responds a CONNECT
 	// request with a successful status code (2XX) but also all the check functions return no errors.
+	// They don't apply to forwarded requests in absolute-form (e.g. `GET http://example.com/ HTTP/1.1`).
 	Checks []Check
 
+	// Classify decides what Proxy does after a failed trial of a backend HTTP proxy if provided. The arguments are the
+	// backend HTTP proxy and the resulting error. Otherwise, Proxy always fails over to the next backend HTTP proxy.
+	// StatusCode reveals the status code of the response from the backend HTTP proxy.
+	Classify func(backend string, err error) Verdict
+
+	// Name identifies Proxy in Proxy-Status header (RFC 9209) of the responses to CONNECT requests if provided.
+	// Otherwise, "httpproxyfailover" is used.
+	Name string
+
+	// RetryAfter is the value of Retry-After header of the response to a CONNECT request for which no backend HTTP
+	// proxy is applicable. If it's 0, 10 seconds is used.
+	RetryAfter time.Duration
+
+	// WriteError writes the response to a CONNECT request which didn't succeed if provided. Otherwise, Proxy responds
+	// with an empty body. WriteText, WriteJSON and RelayLast are available. The exported errors such as ErrUnavailable
+	// tell why it didn't succeed.
+	WriteError ErrorWriter
+
 	// OnConnect is signaled after every trial of the backend HTTP proxies if provided.
 	// The first argument is the CONNECT request, the second argument is the backend HTTP proxy in trial, and the last
-	// argument is the resulting error which is nil if it succeeded.
+	// argument is the resulting error which is nil if it succeeded. TrialBackend reveals further details of the
+	// backend HTTP proxy from the first argument.
 	OnConnect func(connect *http.Request, backend string, err error)
 
 	// OnDisconnect is signaled after closing a connection to a backend HTTP proxy. The arguments are the numbers of
@@ -50,11 +141,21 @@ type Proxy struct {
 type Check = func(ctx context.Context, connect *http.Request, backend string) error
 
 func (p Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	_ = r.Body.Close()
-	switch r.Method {
-	case http.MethodConnect:
+	if p.OnConnect == nil {
+		p.OnConnect = func(*http.Request, string, error) {}
+	}
+	if p.OnDisconnect == nil {
+		p.OnDisconnect = func(read, wrote int64) {}
+	}
+
+	switch {
+	case r.Method == http.MethodConnect:
+		_ = r.Body.Close()
 		p.connect(w, r)
+	case r.URL.IsAbs() && r.URL.Scheme == "http":
+		p.forward(w, r)
 	default:
+		_ = r.Body.Close()
 		http.Error(w, "", http.StatusMethodNotAllowed)
 	}
 }
@@ -66,10 +167,13 @@ func (p Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 // Each pair is separated by '=' without whitespaces, and those pairs are separated by ',' without whitespaces.
 // Optionally, you can omit '=' and the value (`k1=v1,k2=v2,tag`). Then it's considered a pair of the key and empty
 // string (`k1=v1,k2=v2,tag=`).
+// A backend can also have annotations following the URI template separated by whitespaces (`http://{domain}:8080 weight=3`).
+// Each annotation is a key-value pair separated by '='. The known keys are `weight` which is used by WeightedRandom and
+// `tier` which assigns the backend to a tier.
 func (p *Proxy) EnableTemplates() error {
-	p.parsedBackends = make([]*uritemplate.Template, len(p.Backends))
+	p.parsedBackends = make([]template, len(p.Backends))
 	for i, b := range p.Backends {
-		t, err := uritemplate.New(b)
+		t, err := parseTemplate(b)
 		if err != nil {
 			p.parsedBackends = nil
 			return fmt.Errorf("%s: %w", b, err)
@@ -79,50 +183,528 @@ func (p *Proxy) EnableTemplates() error {
 	return nil
 }
 
+// Backend is an applicable backend HTTP proxy for a CONNECT request.
+type Backend struct {
+	// URL is the URL of the backend HTTP proxy with template variables expanded.
+	URL string
+
+	// Weight is the relative weight of the backend HTTP proxy. It's 1 unless annotated otherwise.
+	Weight int
+
+	// Tier is the tier of the backend HTTP proxy. It's 0 unless annotated otherwise.
+	Tier int
+}
+
+// template is a parsed element of Proxy.Backends.
+type template struct {
+	*uritemplate.Template
+	weight int
+	tier   int
+}
+
+func parseTemplate(s string) (template, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return template{}, errors.New("empty backend")
+	}
+
+	t, err := uritemplate.New(fields[0])
+	if err != nil {
+		return template{}, err
+	}
+
+	ret := template{
+		Template: t,
+		weight:   1,
+	}
+	for _, a := range fields[1:] {
+		kv := strings.SplitN(a, "=", 2)
+		if len(kv) != 2 {
+			return template{}, fmt.Errorf("invalid annotation: %s", a)
+		}
+		switch kv[0] {
+		case "weight":
+			w, err := strconv.Atoi(kv[1])
+			if err != nil {
+				return template{}, fmt.Errorf("invalid weight: %w", err)
+			}
+			if w <= 0 {
+				return template{}, fmt.Errorf("non-positive weight: %d", w)
+			}
+			ret.weight = w
+		case "tier":
+			t, err := strconv.Atoi(kv[1])
+			if err != nil {
+				return template{}, fmt.Errorf("invalid tier: %w", err)
+			}
+			ret.tier = t
+		default:
+			return template{}, fmt.Errorf("unknown annotation: %s", kv[0])
+		}
+	}
+	return ret, nil
+}
+
 func (p Proxy) connect(w http.ResponseWriter, r *http.Request) {
-	if p.OnConnect == nil {
-		p.OnConnect = func(*http.Request, string, error) {}
+	backends, ok := p.backends(w, r)
+	if !ok {
+		return
 	}
-	if p.OnDisconnect == nil {
-		p.OnDisconnect = func(read, wrote int64) {}
+
+	t, failures, err := p.tunnel(r, backends)
+	if err != nil {
+		p.fail(w, r, err, failures)
+		return
+	}
+
+	if p.Sessions != nil {
+		p.Sessions.pin(r, t.backend.URL)
+	}
+
+	h, ok := w.(http.Hijacker)
+	if !ok {
+		_ = t.inbound.Close()
+		w.Header().Set("Proxy-Status", p.proxyStatus(t.backend.URL, &typedError{errorType: "proxy_internal_error", err: http.ErrNotSupported}))
+		http.Error(w, "", http.StatusBadGateway)
+		return
+	}
+
+	outbound, _, err := h.Hijack()
+	if err != nil {
+		_ = t.inbound.Close()
+		w.Header().Set("Proxy-Status", p.proxyStatus(t.backend.URL, &typedError{errorType: "proxy_internal_error", err: err}))
+		http.Error(w, "", http.StatusBadGateway)
+		return
+	}
+
+	if p.Tunnels != nil {
+		p.Tunnels.open(t.backend.URL)
+		defer p.Tunnels.close(t.backend.URL)
 	}
 
+	t.resp.Header.Add("Proxy-Status", p.proxyStatus(t.backend.URL, nil))
+	_ = t.resp.Write(outbound)
+	p.OnDisconnect(pipe(t.inbound, outbound))
+}
+
+// tunnel establishes a tunnel for the CONNECT request through one of the backends.
+func (p *Proxy) tunnel(r *http.Request, backends []Backend) (trial, []Failure, error) {
+	return p.try(r, p.order(r, backends), func(ctx context.Context, b Backend) trial {
+		inbound, resp, err := p.connectOne(ctx, b.URL, r)
+		return trial{
+			backend: b,
+			inbound: inbound,
+			resp:    resp,
+			err:     err,
+		}
+	})
+}
+
+// backends returns the applicable backends for the request. If there's none, it responds to the request and
+// returns false.
+func (p *Proxy) backends(w http.ResponseWriter, r *http.Request) ([]Backend, bool) {
+	backends, err := p.candidates(r)
+	if err != nil {
+		p.fail(w, r, err, nil)
+		return nil, false
+	}
+	return backends, true
+}
+
+// candidates returns the applicable backends for the request. If there's none, it returns an error.
+func (p *Proxy) candidates(r *http.Request) ([]Backend, error) {
 	backends, err := p.applicableBackends(r)
 	if err != nil {
-		http.Error(w, "", http.StatusBadRequest)
+		return nil, fmt.Errorf("%w: %v", ErrInvalidProxyAuthorization, err)
+	}
+	if len(backends) == 0 {
+		if r.Header.Get("Proxy-Authorization") == "" && p.requiresParams() {
+			return nil, ErrProxyAuthRequired
+		}
+		return nil, ErrNoApplicableBackend
+	}
+	return backends, nil
+}
+
+// fail responds to the request which didn't succeed.
+func (p *Proxy) fail(w http.ResponseWriter, r *http.Request, err error, failures []Failure) {
+	statusCode, body := http.StatusServiceUnavailable, ""
+	var ff *FailFastError
+	switch {
+	case errors.Is(err, ErrInvalidProxyAuthorization):
+		statusCode = http.StatusBadRequest
+	case errors.Is(err, ErrProxyAuthRequired):
+		statusCode = http.StatusProxyAuthRequired
+		w.Header().Set("Proxy-Authenticate", fmt.Sprintf("Basic realm=%q", p.name()))
+	case errors.Is(err, ErrNoApplicableBackend):
+		retryAfter := p.RetryAfter
+		if retryAfter == 0 {
+			retryAfter = 10 * time.Second
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(int((retryAfter+time.Second-1)/time.Second)))
+	case errors.Is(err, ErrTimeout):
+		statusCode = http.StatusGatewayTimeout
+	case errors.Is(err, ErrBudgetExhausted), errors.Is(err, ErrRetryBudgetExhausted):
+		body = err.Error()
+	case errors.As(err, &ff):
+		statusCode, body = http.StatusBadGateway, ff.Err.Error()
+	}
+
+	// The last failure is the most relevant. If there's none, it's on Proxy itself.
+	if len(failures) > 0 {
+		f := failures[len(failures)-1]
+		w.Header().Set("Proxy-Status", p.proxyStatus(f.Backend.URL, f.Err))
+	} else {
+		w.Header().Set("Proxy-Status", p.proxyStatus("", err))
+	}
+
+	if p.WriteError != nil {
+		p.WriteError(w, r, statusCode, err, failures)
 		return
 	}
+	http.Error(w, body, statusCode)
+}
 
-	for _, b := range backends {
-		inbound, resp, err := p.connectOne(b, r)
-		p.OnConnect(r, b, err)
-		if err != nil {
+type trial struct {
+	backend Backend
+	inbound net.Conn
+	resp    *http.Response
+	err     error
+
+	// fatal reports whether Proxy can't fail over to the other backend HTTP proxies after the failed trial.
+	fatal bool
+}
+
+// close closes the connection to the backend HTTP proxy of the successful trial.
+func (t *trial) close() {
+	if t.inbound != nil {
+		_ = t.inbound.Close()
+	}
+	if t.resp != nil {
+		_ = t.resp.Body.Close()
+	}
+}
+
+// trialFunc tries the backend HTTP proxy.
+type trialFunc func(ctx context.Context, b Backend) trial
+
+var (
+	// ErrInvalidProxyAuthorization is the error for a CONNECT request with a malformed Proxy-Authorization header.
+	// Proxy responds with 400 Bad Request.
+	ErrInvalidProxyAuthorization = errors.New("invalid proxy authorization")
+
+	// ErrProxyAuthRequired is the error for a CONNECT request without Proxy-Authorization header while all the backend
+	// HTTP proxies require template variables. Proxy responds with 407 Proxy Authentication Required.
+	ErrProxyAuthRequired = errors.New("proxy authentication required")
+
+	// ErrNoApplicableBackend is the error for a CONNECT request for which no backend HTTP proxy is applicable.
+	// Proxy responds with 503 Service Unavailable with Retry-After header.
+	ErrNoApplicableBackend = errors.New("no applicable backend")
+
+	// ErrUnavailable is the error for a CONNECT request after which all the trials failed.
+	// Proxy responds with 503 Service Unavailable.
+	ErrUnavailable = errors.New("no available backend")
+
+	// ErrTimeout is the error for a CONNECT request after which all the trials timed out or which ran out of
+	// Proxy.Deadline.
+	// Proxy responds with 504 Gateway Timeout.
+	ErrTimeout = errors.New("all trials timed out")
+
+	// ErrBudgetExhausted is the error for a CONNECT request which ran out of Proxy.MaxAttempts.
+	// Proxy responds with 503 Service Unavailable with the error in the body.
+	ErrBudgetExhausted = errors.New("max attempts exhausted")
+
+	// ErrRetryBudgetExhausted is the error for a CONNECT request which ran out of Proxy.RetryBudget.
+	// Proxy responds with 503 Service Unavailable.
+	ErrRetryBudgetExhausted = errors.New("retry budget exhausted")
+)
+
+// progress is the progress of the trials for a CONNECT request.
+type progress struct {
+	attempts int
+	failures []Failure
+}
+
+// try tries backends in order and returns the first successful trial.
+// If all of them fail, it tries them again up to Retries times with backoff. It also returns the failed trials.
+func (p *Proxy) try(r *http.Request, backends []Backend, f trialFunc) (trial, []Failure, error) {
+	ctx := r.Context()
+	if p.Deadline != 0 {
+		var cancel func()
+		ctx, cancel = context.WithTimeout(ctx, p.Deadline)
+		defer cancel()
+	}
+
+	if p.RetryBudget != nil {
+		p.RetryBudget.deposit()
+	}
+
+	var prog progress
+	for i := 0; ; i++ {
+		t, err := p.round(ctx, r, backends, &prog, f)
+		if err != ErrUnavailable && err != ErrBudgetExhausted {
+			return t, prog.failures, err
+		}
+		if err == ErrUnavailable && i < p.Retries {
+			select {
+			case <-ctx.Done():
+			case <-time.After(p.backoff(i)):
+				continue
+			}
+		}
+		if err == ErrBudgetExhausted {
+			return trial{}, prog.failures, ErrBudgetExhausted
+		}
+		if (ctx.Err() == context.DeadlineExceeded && r.Context().Err() == nil) || timedOut(prog.failures) {
+			return trial{}, prog.failures, ErrTimeout
+		}
+		return trial{}, prog.failures, ErrUnavailable
+	}
+}
+
+// round tries backends in order and returns the first successful trial.
+// If Race is more than 1, it keeps that many trials in flight. If HedgeDelay is provided, it starts another trial
+// every time the delay passes. Once a trial succeeds, the others are canceled.
+func (p *Proxy) round(ctx context.Context, r *http.Request, backends []Backend, prog *progress, f trialFunc) (trial, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	race := p.Race
+	if race < 1 {
+		race = 1
+	}
+
+	trials := make(chan trial)
+	var next, running, tier int
+	var exhausted, denied bool
+	var hedge <-chan time.Time
+	start := func() bool {
+		for next < len(backends) {
+			// Trials in flight have to fail before moving on to the next tier.
+			if running > 0 && backends[next].Tier != tier {
+				return false
+			}
+			if ctx.Err() == context.DeadlineExceeded {
+				return false
+			}
+			if p.MaxAttempts > 0 && prog.attempts >= p.MaxAttempts {
+				exhausted = true
+				return false
+			}
+			b := backends[next]
+			next++
+			err := p.available(b.URL)
+			if p.SlowStart != nil {
+				p.SlowStart.observe(b.URL, err == nil)
+			}
+			if err != nil {
+				p.report(r, b, err, prog)
+				continue
+			}
+			if prog.attempts > 0 && p.RetryBudget != nil && !p.RetryBudget.withdraw() {
+				p.release(b.URL)
+				denied = true
+				return false
+			}
+			running++
+			prog.attempts++
+			tier = b.Tier
+			hedge = nil
+			if p.HedgeDelay > 0 && next < len(backends) && backends[next].Tier == tier {
+				hedge = time.After(p.HedgeDelay)
+			}
+			go func() {
+				trials <- f(ctx, b)
+			}()
+			return true
+		}
+		return false
+	}
+
+	for running < race && start() {
+	}
+
+	var won trial
+	var ok bool
+	var failed error
+	var failedBackend Backend
+	for running > 0 {
+		var t trial
+		select {
+		case t = <-trials:
+		case <-hedge:
+			start()
 			continue
 		}
+		running--
 
-		h, ok := w.(http.Hijacker)
-		if !ok {
-			http.Error(w, "", http.StatusBadGateway)
-			return
+		p.observe(t.backend.URL, t.err)
+
+		if (ok || failed != nil) && t.err == nil {
+			t.close()
+			t.err = context.Canceled
 		}
 
-		outbound, _, err := h.Hijack()
-		if err != nil {
-			http.Error(w, "", http.StatusBadGateway)
-			return
+		p.report(r, t.backend, t.err, prog)
+
+		if ok || failed != nil {
+			continue
 		}
 
-		_ = resp.Write(outbound)
-		p.OnDisconnect(pipe(inbound, outbound))
-		return
+		if t.err != nil {
+			v := p.classify(t.backend.URL, t.err)
+			if t.fatal {
+				v = FailFast
+			}
+			switch v {
+			case FailFast:
+				failed, failedBackend = t.err, t.backend
+				hedge = nil
+				cancel()
+				continue
+			case MarkUnhealthy:
+				p.markUnhealthy(t.backend.URL, t.err)
+			}
+			start()
+			for running < race && start() {
+			}
+			continue
+		}
+
+		won, ok = t, true
+		hedge = nil
+		cancel()
 	}
 
-	http.Error(w, "", http.StatusServiceUnavailable)
+	switch {
+	case ok:
+		return won, nil
+	case failed != nil:
+		return trial{}, &FailFastError{Backend: failedBackend, Err: failed}
+	case exhausted:
+		return trial{}, ErrBudgetExhausted
+	case denied:
+		return trial{}, ErrRetryBudgetExhausted
+	default:
+		return trial{}, ErrUnavailable
+	}
 }
 
-func (p *Proxy) applicableBackends(r *http.Request) ([]string, error) {
+// timedOut reports whether all the trials timed out. Backends skipped without trials don't count.
+func timedOut(failures []Failure) bool {
+	var n int
+	for _, f := range failures {
+		switch f.Err {
+		case ErrUnhealthy, ErrCircuitOpen, ErrEjected:
+			continue
+		}
+		var netErr net.Error
+		if !errors.Is(f.Err, context.DeadlineExceeded) && !(errors.As(f.Err, &netErr) && netErr.Timeout()) {
+			return false
+		}
+		n++
+	}
+	return n > 0
+}
+
+// report signals OnConnect and keeps the failed trial.
+func (p *Proxy) report(r *http.Request, b Backend, err error, prog *progress) {
+	p.OnConnect(withTrialBackend(r, b), b.URL, err)
+	if err != nil {
+		prog.failures = append(prog.failures, Failure{Backend: b, Err: err})
+	}
+}
+
+// backoff returns the delay before the (i+1)-th retry. It's exponential with jitter.
+func (p *Proxy) backoff(i int) time.Duration {
+	base, max := p.RetryBackoff, p.MaxRetryBackoff
+	if base == 0 {
+		base = 100 * time.Millisecond
+	}
+	if max == 0 {
+		max = 10 * time.Second
+	}
+
+	d := base
+	for ; i > 0 && d < max; i-- {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// available returns an error if the backend should be skipped without a trial.
+func (p *Proxy) available(backend string) error {
+	if p.HealthCheck != nil && !p.HealthCheck.watch(backend) {
+		return ErrUnhealthy
+	}
+	if p.Outliers != nil && !p.Outliers.allow(backend) {
+		return ErrEjected
+	}
+	// Breakers go last since a half-open circuit gives away its single trial.
+	if p.Breakers != nil && !p.Breakers.allow(backend) {
+		return ErrCircuitOpen
+	}
+	return nil
+}
+
+// release gives back the trial which available allowed but didn't start.
+func (p *Proxy) release(backend string) {
+	if p.Breakers != nil {
+		p.Breakers.release(backend)
+	}
+}
+
+// observe records the result of a trial.
+func (p *Proxy) observe(backend string, err error) {
+	if p.Breakers != nil {
+		p.Breakers.record(backend, err)
+	}
+	if p.Outliers != nil {
+		p.Outliers.record(backend, err)
+	}
+}
+
+// classify decides what to do after a failed trial.
+func (p *Proxy) classify(backend string, err error) Verdict {
+	if p.Classify == nil {
+		return FailOver
+	}
+	return p.Classify(backend, err)
+}
+
+// markUnhealthy makes the backend skipped from then on.
+func (p *Proxy) markUnhealthy(backend string, err error) {
+	if p.Breakers != nil {
+		p.Breakers.trip(backend)
+	}
+	if p.HealthCheck != nil {
+		p.HealthCheck.fail(backend, err)
+	}
+}
+
+// requiresParams reports whether all the backends require template variables.
+func (p *Proxy) requiresParams() bool {
+	if len(p.parsedBackends) == 0 {
+		return false
+	}
+	for _, t := range p.parsedBackends {
+		if len(t.Varnames()) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *Proxy) applicableBackends(r *http.Request) ([]Backend, error) {
 	if p.parsedBackends == nil {
-		return p.Backends, nil
+		ret := make([]Backend, len(p.Backends))
+		for i, b := range p.Backends {
+			ret[i] = Backend{URL: b, Weight: 1}
+		}
+		return ret, nil
 	}
 
 	values, err := params(r)
@@ -130,20 +712,66 @@ func (p *Proxy) applicableBackends(r *http.Request) ([]string, error) {
 		return nil, err
 	}
 
-	ret := make([]string, 0, len(p.parsedBackends))
+	ret := make([]Backend, 0, len(p.parsedBackends))
 	for _, t := range p.parsedBackends {
-		if !applicable(t, values) {
+		if !applicable(t.Template, values) {
 			continue
 		}
 		b, err := t.Expand(values)
 		if err != nil {
 			continue
 		}
-		ret = append(ret, b)
+		ret = append(ret, Backend{URL: b, Weight: t.weight, Tier: t.tier})
 	}
 	return ret, nil
 }
 
+// order decides the order of trials.
+func (p *Proxy) order(r *http.Request, backends []Backend) []Backend {
+	tiers := map[int][]Backend{}
+	var keys []int
+	for _, b := range backends {
+		if _, ok := tiers[b.Tier]; !ok {
+			keys = append(keys, b.Tier)
+		}
+		tiers[b.Tier] = append(tiers[b.Tier], b)
+	}
+	sort.Ints(keys)
+
+	ret := make([]Backend, 0, len(backends))
+	for _, k := range keys {
+		bs := tiers[k]
+		s, ok := p.Tiers[k]
+		if !ok {
+			s = p.Selector
+		}
+		if s != nil {
+			bs = s.Select(r, bs)
+		}
+		if p.SlowStart != nil {
+			bs = p.SlowStart.ramp(bs)
+		}
+		if p.Sessions != nil {
+			bs = p.Sessions.prefer(r, bs)
+		}
+		ret = append(ret, bs...)
+	}
+
+	return ret
+}
+
+type trialBackendKey struct{}
+
+func withTrialBackend(connect *http.Request, b Backend) *http.Request {
+	return connect.WithContext(context.WithValue(connect.Context(), trialBackendKey{}, b))
+}
+
+// TrialBackend returns the backend HTTP proxy in trial for the CONNECT request passed to OnConnect.
+func TrialBackend(connect *http.Request) (Backend, bool) {
+	b, ok := connect.Context().Value(trialBackendKey{}).(Backend)
+	return b, ok
+}
+
 func applicable(t *uritemplate.Template, values uritemplate.Values) bool {
 	for _, n := range t.Varnames() {
 		if _, ok := values[n]; !ok {
@@ -186,27 +814,52 @@ func params(r *http.Request) (uritemplate.Values, error) {
 }
 
 func urlParse(raw string) (*url.URL, error) {
-	if !strings.HasPrefix(raw, "http://") {
+	if !strings.Contains(raw, "://") {
 		raw = "http://" + raw
 	}
-	return url.Parse(raw)
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "socks4", "socks4a", "socks5", "socks5h":
+		return u, nil
+	case "https":
+		if err := validateTLSParams(u.Query()); err != nil {
+			return nil, err
+		}
+		return u, nil
+	default:
+		return nil, fmt.Errorf("unsupported scheme: %s", u.Scheme)
+	}
 }
 
-func (p *Proxy) connectOne(b string, r *http.Request) (net.Conn, *http.Response, error) {
-	ctx := r.Context()
+func (p *Proxy) connectOne(ctx context.Context, b string, r *http.Request) (net.Conn, *http.Response, error) {
 	if p.Timeout != 0 {
 		var cancel func()
-		ctx, cancel = context.WithTimeout(r.Context(), p.Timeout)
+		ctx, cancel = context.WithTimeout(ctx, p.Timeout)
 		defer cancel()
 	}
 
+	start := time.Now()
 	inbound, resp, err := inbound(ctx, r, b)
 	if err != nil {
+		// A canceled trial doesn't tell anything about the backend.
+		if p.Latencies != nil && !errors.Is(err, context.Canceled) {
+			p.Latencies.fail(b)
+		}
 		return nil, nil, err
 	}
+	if p.Latencies != nil {
+		p.Latencies.record(b, time.Since(start))
+	}
 
 	for _, c := range p.Checks {
 		if err := c(ctx, r, b); err != nil {
+			_ = inbound.Close()
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			}
 			return nil, nil, err
 		}
 	}
@@ -282,10 +935,7 @@ func CheckFavicon(ctx context.Context, connect *http.Request, backend string) er
 	}
 
 	c := http.Client{
-		Transport: &http.Transport{
-			Proxy:           http.ProxyURL(u),
-			TLSClientConfig: &TLS,
-		},
+		Transport: checkTransport(u, connect),
 	}
 
 	target := url.URL{
@@ -341,10 +991,7 @@ func CheckGET(urls ...string) func(ctx context.Context, connect *http.Request, b
 		}
 
 		c := http.Client{
-			Transport: &http.Transport{
-				Proxy:           http.ProxyURL(u),
-				TLSClientConfig: &TLS,
-			},
+			Transport: checkTransport(u, connect),
 		}
 
 		errs := make([]error, 0, len(urls))
@@ -375,38 +1022,112 @@ func CheckGET(urls ...string) func(ctx context.Context, connect *http.Request, b
 	}
 }
 
+// checkTransport returns a transport for checks through the backend HTTP proxy.
+// For a SOCKS or HTTPS backend proxy, it establishes tunnels just like the ones for CONNECT requests.
+func checkTransport(u *url.URL, connect *http.Request) *http.Transport {
+	if u.Scheme == "http" {
+		return &http.Transport{
+			Proxy:           http.ProxyURL(u),
+			TLSClientConfig: &TLS,
+		}
+	}
+	return &http.Transport{
+		DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+			c := connect.Clone(ctx)
+			c.Host = addr
+			c.RequestURI = addr
+			c.URL = &url.URL{Host: addr}
+			conn, _, err := inbound(ctx, c, u.String())
+			return conn, err
+		},
+		TLSClientConfig: &TLS,
+	}
+}
+
 func inbound(ctx context.Context, connect *http.Request, backend string) (net.Conn, *http.Response, error) {
 	u, err := urlParse(backend)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	var d net.Dialer
-	inbound, err := d.DialContext(ctx, "tcp", u.Host)
+	inbound, err := dial(ctx, u)
 	if err != nil {
+		// Report the trial canceled or timed out while dialing just like the one canceled or timed out afterwards.
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
 		return nil, nil, err
 	}
 
-	req := backendReq(connect, u.User)
-	if err := req.Write(inbound); err != nil {
+	stop := interrupt(ctx, inbound)
+	var resp *http.Response
+	if isSOCKS(u) {
+		err = socks(ctx, inbound, u, connect.Host)
+		resp = established()
+	} else {
+		resp, err = handshake(inbound, connect, u.User)
+	}
+	if stop() {
+		_ = inbound.Close()
+		return nil, nil, ctx.Err()
+	}
+	if err != nil {
+		_ = inbound.Close()
 		return nil, nil, err
 	}
 
+	return inbound, resp, nil
+}
+
+func handshake(inbound net.Conn, connect *http.Request, userinfo *url.Userinfo) (*http.Response, error) {
+	req := backendReq(connect, userinfo)
+	if err := req.Write(inbound); err != nil {
+		return nil, err
+	}
+
 	br := bufio.NewReader(inbound)
 	resp, err := http.ReadResponse(br, connect)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
-	_ = resp.Body.Close()
 
 	if resp.StatusCode/100 != 2 {
-		return nil, nil, &unsuccessfulStatusError{
+		// Keep the response for WriteError.
+		body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+		_ = resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		return nil, &unsuccessfulStatusError{
 			statusCode: resp.StatusCode,
 			status:     resp.Status,
+			header:     resp.Header,
+			body:       body,
 		}
 	}
+	_ = resp.Body.Close()
 
-	return inbound, resp, nil
+	return resp, nil
+}
+
+// interrupt makes blocking reads from and writes to conn return immediately once ctx is done.
+// The returned function stops it and reports whether conn was interrupted.
+func interrupt(ctx context.Context, conn net.Conn) func() bool {
+	done := make(chan struct{})
+	interrupted := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.SetDeadline(time.Unix(1, 0))
+			interrupted <- true
+		case <-done:
+			interrupted <- false
+		}
+	}()
+	return func() bool {
+		close(done)
+		return <-interrupted
+	}
 }
 
 func backendReq(r *http.Request, userinfo *url.Userinfo) *http.Request {
@@ -426,9 +1147,14 @@ func backendReq(r *http.Request, userinfo *url.Userinfo) *http.Request {
 	return &req
 }
 
+// maxErrorBody is the maximum size of the body of an unsuccessful response from a backend HTTP proxy to keep.
+const maxErrorBody = 64 << 10
+
 type unsuccessfulStatusError struct {
 	statusCode int
 	status     string
+	header     http.Header
+	body       []byte
 }
 
 func (err *unsuccessfulStatusError) Error() string {
@@ -437,3 +1163,18 @@ func (err *unsuccessfulStatusError) Error() string {
 	}
 	return fmt.Sprintf("%d %s", err.statusCode, http.StatusText(err.statusCode))
 }
+
+// FailFastError is the error for a CONNECT request after which Proxy stopped trying the other backend HTTP proxies
+// since Proxy.Classify returned FailFast.
+type FailFastError struct {
+	Backend Backend
+	Err     error
+}
+
+func (err *FailFastError) Error() string {
+	return err.Err.Error()
+}
+
+func (err *FailFastError) Unwrap() error {
+	return err.Err
+}
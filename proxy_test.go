@@ -2,9 +2,12 @@ package httpproxyfailover
 
 import (
 	"bufio"
+	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httptest"
@@ -118,6 +121,635 @@ func TestProxies_ServeHTTP(t *testing.T) {
 			assert.Equal(t, http.StatusOK, resp.StatusCode)
 		})
 
+		t.Run("no applicable backend", func(t *testing.T) {
+			var c MockCallback
+			defer c.AssertExpectations(t)
+
+			h := Proxy{
+				Backends:     []string{"{foo}" + strings.Replace(proxy1URL("proxy1", "proxy1"), "proxy", "{proxy}", -1)},
+				OnConnect:    c.OnConnect,
+				OnDisconnect: c.OnDisconnect,
+			}
+			assert.NoError(t, h.EnableTemplates())
+
+			w := newRecorder()
+			r := httptest.NewRequest(http.MethodConnect, originURL.Host, nil)
+			r.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("bar,proxy=proxy")))
+			h.ServeHTTP(w, r)
+			assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+			assert.Equal(t, "10", w.Header().Get("Retry-After"))
+		})
+
+		t.Run("proxy authentication required", func(t *testing.T) {
+			var c MockCallback
+			defer c.AssertExpectations(t)
+
+			h := Proxy{
+				Backends:     []string{"{foo}" + strings.Replace(proxy1URL("proxy1", "proxy1"), "proxy", "{proxy}", -1)},
+				OnConnect:    c.OnConnect,
+				OnDisconnect: c.OnDisconnect,
+			}
+			assert.NoError(t, h.EnableTemplates())
+
+			w := newRecorder()
+			r := httptest.NewRequest(http.MethodConnect, originURL.Host, nil)
+			h.ServeHTTP(w, r)
+			assert.Equal(t, http.StatusProxyAuthRequired, w.Code)
+			assert.Equal(t, `Basic realm="httpproxyfailover"`, w.Header().Get("Proxy-Authenticate"))
+		})
+
+		t.Run("invalid proxy authorization", func(t *testing.T) {
+			var c MockCallback
+			defer c.AssertExpectations(t)
+
+			var got error
+			h := Proxy{
+				Backends: []string{"{foo}" + strings.Replace(proxy1URL("proxy1", "proxy1"), "proxy", "{proxy}", -1)},
+				WriteError: func(w http.ResponseWriter, _ *http.Request, statusCode int, err error, _ []Failure) {
+					got = err
+					w.WriteHeader(statusCode)
+				},
+				OnConnect:    c.OnConnect,
+				OnDisconnect: c.OnDisconnect,
+			}
+			assert.NoError(t, h.EnableTemplates())
+
+			w := newRecorder()
+			r := httptest.NewRequest(http.MethodConnect, originURL.Host, nil)
+			r.Header.Set("Proxy-Authorization", "Basic !!!")
+			h.ServeHTTP(w, r)
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+			assert.True(t, errors.Is(got, ErrInvalidProxyAuthorization))
+		})
+
+		t.Run("OK with SOCKS5", func(t *testing.T) {
+			backend := socks5Server(t, "user", "pass")
+			defer func() {
+				assert.NoError(t, backend.Close())
+			}()
+			wrong := fmt.Sprintf("socks5://user:wrong@%s", backend.Addr())
+			right := fmt.Sprintf("socks5h://user:pass@%s", backend.Addr())
+
+			var c MockCallback
+			c.On("OnConnect", mock.AnythingOfType("*http.Request"), wrong, errSOCKSAuth).Return()
+			c.On("OnConnect", mock.AnythingOfType("*http.Request"), right, nil).Return()
+			c.On("OnDisconnect", int64(0), int64(0)).Return()
+			defer c.AssertExpectations(t)
+
+			h := Proxy{
+				Backends:     []string{wrong, right},
+				OnConnect:    c.OnConnect,
+				OnDisconnect: c.OnDisconnect,
+			}
+
+			w := newRecorder()
+			r := httptest.NewRequest(http.MethodConnect, originURL.Host, nil)
+			h.ServeHTTP(w, r)
+			assert.Equal(t, http.StatusOK, w.Code)
+		})
+
+		t.Run("OK with selector", func(t *testing.T) {
+			proxy1Status = http.StatusServiceUnavailable
+			defer func() {
+				proxy1Status = http.StatusOK
+			}()
+
+			var c MockCallback
+			c.On("OnConnect", mock.AnythingOfType("*http.Request"), proxy2URL("proxy2", "proxy2"), nil).Return().Once()
+			c.On("OnConnect", mock.AnythingOfType("*http.Request"), proxy1URL("proxy1", "proxy1"), mock.MatchedBy(func(err error) bool {
+				e, ok := err.(*unsuccessfulStatusError)
+				if !ok {
+					return false
+				}
+
+				return e.statusCode == http.StatusServiceUnavailable
+			})).Return().Once()
+			c.On("OnConnect", mock.AnythingOfType("*http.Request"), proxy2URL("proxy2", "proxy2"), nil).Return().Once()
+			c.On("OnDisconnect", int64(0), int64(0)).Return()
+			defer c.AssertExpectations(t)
+
+			var s RoundRobin
+			s.Select(nil, backends(proxy1URL("proxy1", "proxy1"), proxy2URL("proxy2", "proxy2")))
+
+			h := Proxy{
+				Backends:     []string{proxy1URL("proxy1", "proxy1"), proxy2URL("proxy2", "proxy2")},
+				Selector:     &s,
+				OnConnect:    c.OnConnect,
+				OnDisconnect: c.OnDisconnect,
+			}
+
+			for i := 0; i < 2; i++ {
+				w := newRecorder()
+				r := httptest.NewRequest(http.MethodConnect, originURL.Host, nil)
+				h.ServeHTTP(w, r)
+				assert.Equal(t, http.StatusOK, w.Code)
+			}
+		})
+
+		t.Run("OK with tunnels", func(t *testing.T) {
+			var tunnels Tunnels
+			var live map[string]int
+
+			h := Proxy{
+				Backends: []string{proxy1URL("proxy1", "proxy1"), proxy2URL("proxy2", "proxy2")},
+				Tunnels:  &tunnels,
+				OnDisconnect: func(read, wrote int64) {
+					live = tunnels.Counts()
+				},
+			}
+
+			w := newRecorder()
+			r := httptest.NewRequest(http.MethodConnect, originURL.Host, nil)
+			h.ServeHTTP(w, r)
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, map[string]int{proxy1URL("proxy1", "proxy1"): 1}, live)
+			assert.Empty(t, tunnels.Counts())
+		})
+
+		t.Run("OK with latencies", func(t *testing.T) {
+			proxy1Status = http.StatusServiceUnavailable
+			defer func() {
+				proxy1Status = http.StatusOK
+			}()
+
+			var latencies Latencies
+			h := Proxy{
+				Backends:  []string{proxy1URL("proxy1", "proxy1"), proxy2URL("proxy2", "proxy2")},
+				Latencies: &latencies,
+			}
+
+			w := newRecorder()
+			r := httptest.NewRequest(http.MethodConnect, originURL.Host, nil)
+			h.ServeHTTP(w, r)
+			assert.Equal(t, http.StatusOK, w.Code)
+
+			// The failed backend gets the penalty instead of staying unmeasured.
+			a, ok := latencies.Average(proxy1URL("proxy1", "proxy1"))
+			assert.True(t, ok)
+			assert.Equal(t, 10*time.Second, a)
+			a, ok = latencies.Average(proxy2URL("proxy2", "proxy2"))
+			assert.True(t, ok)
+			assert.True(t, a < time.Second)
+			assert.Equal(t, backends(proxy2URL("proxy2", "proxy2"), proxy1URL("proxy1", "proxy1")), PowerOfTwoChoices{Latencies: &latencies}.Select(r, backends(proxy1URL("proxy1", "proxy1"), proxy2URL("proxy2", "proxy2"))))
+		})
+
+		t.Run("OK with race", func(t *testing.T) {
+			slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				<-r.Context().Done()
+			}))
+			defer slow.Close()
+
+			var c MockCallback
+			c.On("OnConnect", mock.AnythingOfType("*http.Request"), slow.URL, context.Canceled).Return()
+			c.On("OnConnect", mock.AnythingOfType("*http.Request"), proxy2URL("proxy2", "proxy2"), nil).Return()
+			c.On("OnDisconnect", int64(0), int64(0)).Return()
+			defer c.AssertExpectations(t)
+
+			h := Proxy{
+				Backends:     []string{slow.URL, proxy2URL("proxy2", "proxy2")},
+				Race:         2,
+				OnConnect:    c.OnConnect,
+				OnDisconnect: c.OnDisconnect,
+			}
+
+			w := newRecorder()
+			r := httptest.NewRequest(http.MethodConnect, originURL.Host, nil)
+			h.ServeHTTP(w, r)
+			assert.Equal(t, http.StatusOK, w.Code)
+		})
+
+		t.Run("OK with hedge", func(t *testing.T) {
+			slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				<-r.Context().Done()
+			}))
+			defer slow.Close()
+
+			var c MockCallback
+			c.On("OnConnect", mock.AnythingOfType("*http.Request"), slow.URL, context.Canceled).Return()
+			c.On("OnConnect", mock.AnythingOfType("*http.Request"), proxy2URL("proxy2", "proxy2"), nil).Return()
+			c.On("OnDisconnect", int64(0), int64(0)).Return()
+			defer c.AssertExpectations(t)
+
+			h := Proxy{
+				Backends:     []string{slow.URL, proxy2URL("proxy2", "proxy2")},
+				HedgeDelay:   10 * time.Millisecond,
+				OnConnect:    c.OnConnect,
+				OnDisconnect: c.OnDisconnect,
+			}
+
+			w := newRecorder()
+			r := httptest.NewRequest(http.MethodConnect, originURL.Host, nil)
+			h.ServeHTTP(w, r)
+			assert.Equal(t, http.StatusOK, w.Code)
+		})
+
+		t.Run("OK with race after failure", func(t *testing.T) {
+			proxy1Status = http.StatusServiceUnavailable
+			defer func() {
+				proxy1Status = http.StatusOK
+			}()
+
+			var c MockCallback
+			c.On("OnConnect", mock.AnythingOfType("*http.Request"), proxy1URL("proxy1", "proxy1"), mock.MatchedBy(func(err error) bool {
+				e, ok := err.(*unsuccessfulStatusError)
+				if !ok {
+					return false
+				}
+
+				return e.statusCode == http.StatusServiceUnavailable
+			})).Return()
+			c.On("OnConnect", mock.AnythingOfType("*http.Request"), "http://localhost:0/", mock.MatchedBy(func(err error) bool {
+				e, ok := err.(*net.OpError)
+				if !ok {
+					return false
+				}
+
+				return e.Op == "dial"
+			})).Return()
+			c.On("OnConnect", mock.AnythingOfType("*http.Request"), proxy2URL("proxy2", "proxy2"), nil).Return()
+			c.On("OnDisconnect", int64(0), int64(0)).Return()
+			defer c.AssertExpectations(t)
+
+			h := Proxy{
+				Backends:     []string{proxy1URL("proxy1", "proxy1"), "http://localhost:0/", proxy2URL("proxy2", "proxy2")},
+				Race:         2,
+				OnConnect:    c.OnConnect,
+				OnDisconnect: c.OnDisconnect,
+			}
+
+			w := newRecorder()
+			r := httptest.NewRequest(http.MethodConnect, originURL.Host, nil)
+			h.ServeHTTP(w, r)
+			assert.Equal(t, http.StatusOK, w.Code)
+		})
+
+		t.Run("OK with breakers", func(t *testing.T) {
+			proxy1Status = http.StatusServiceUnavailable
+			defer func() {
+				proxy1Status = http.StatusOK
+			}()
+
+			var c MockCallback
+			c.On("OnConnect", mock.AnythingOfType("*http.Request"), proxy1URL("proxy1", "proxy1"), mock.MatchedBy(func(err error) bool {
+				e, ok := err.(*unsuccessfulStatusError)
+				if !ok {
+					return false
+				}
+
+				return e.statusCode == http.StatusServiceUnavailable
+			})).Return().Once()
+			c.On("OnConnect", mock.AnythingOfType("*http.Request"), proxy1URL("proxy1", "proxy1"), ErrCircuitOpen).Return().Once()
+			c.On("OnConnect", mock.AnythingOfType("*http.Request"), proxy2URL("proxy2", "proxy2"), nil).Return().Twice()
+			c.On("OnDisconnect", int64(0), int64(0)).Return()
+			defer c.AssertExpectations(t)
+
+			h := Proxy{
+				Backends:     []string{proxy1URL("proxy1", "proxy1"), proxy2URL("proxy2", "proxy2")},
+				Breakers:     &Breakers{Threshold: 1},
+				OnConnect:    c.OnConnect,
+				OnDisconnect: c.OnDisconnect,
+			}
+
+			for i := 0; i < 2; i++ {
+				w := newRecorder()
+				r := httptest.NewRequest(http.MethodConnect, originURL.Host, nil)
+				h.ServeHTTP(w, r)
+				assert.Equal(t, http.StatusOK, w.Code)
+			}
+			assert.Equal(t, BreakerOpen, h.Breakers.State(proxy1URL("proxy1", "proxy1")))
+		})
+
+		t.Run("fail fast", func(t *testing.T) {
+			proxy1Status = http.StatusProxyAuthRequired
+			defer func() {
+				proxy1Status = http.StatusOK
+			}()
+
+			var c MockCallback
+			c.On("OnConnect", mock.AnythingOfType("*http.Request"), proxy1URL("proxy1", "proxy1"), mock.MatchedBy(func(err error) bool {
+				e, ok := err.(*unsuccessfulStatusError)
+				if !ok {
+					return false
+				}
+
+				return e.statusCode == http.StatusProxyAuthRequired
+			})).Return()
+			defer c.AssertExpectations(t)
+
+			h := Proxy{
+				Backends:     []string{proxy1URL("proxy1", "proxy1"), proxy2URL("proxy2", "proxy2")},
+				Classify:     StatusClassifier{http.StatusProxyAuthRequired: FailFast}.Classify,
+				OnConnect:    c.OnConnect,
+				OnDisconnect: c.OnDisconnect,
+			}
+
+			w := newRecorder()
+			r := httptest.NewRequest(http.MethodConnect, originURL.Host, nil)
+			h.ServeHTTP(w, r)
+			assert.Equal(t, http.StatusBadGateway, w.Code)
+			assert.Contains(t, w.Body.String(), "407")
+			assert.Contains(t, w.Header().Get("Proxy-Status"), "error=http_request_denied; received-status=407")
+		})
+
+		t.Run("OK with mark unhealthy", func(t *testing.T) {
+			proxy1Status = http.StatusForbidden
+			defer func() {
+				proxy1Status = http.StatusOK
+			}()
+
+			var c MockCallback
+			c.On("OnConnect", mock.AnythingOfType("*http.Request"), proxy1URL("proxy1", "proxy1"), mock.MatchedBy(func(err error) bool {
+				e, ok := err.(*unsuccessfulStatusError)
+				if !ok {
+					return false
+				}
+
+				return e.statusCode == http.StatusForbidden
+			})).Return().Once()
+			c.On("OnConnect", mock.AnythingOfType("*http.Request"), proxy1URL("proxy1", "proxy1"), ErrCircuitOpen).Return().Once()
+			c.On("OnConnect", mock.AnythingOfType("*http.Request"), proxy2URL("proxy2", "proxy2"), nil).Return().Twice()
+			c.On("OnDisconnect", int64(0), int64(0)).Return()
+			defer c.AssertExpectations(t)
+
+			h := Proxy{
+				Backends:     []string{proxy1URL("proxy1", "proxy1"), proxy2URL("proxy2", "proxy2")},
+				Breakers:     &Breakers{},
+				Classify:     StatusClassifier{http.StatusForbidden: MarkUnhealthy}.Classify,
+				OnConnect:    c.OnConnect,
+				OnDisconnect: c.OnDisconnect,
+			}
+
+			for i := 0; i < 2; i++ {
+				w := newRecorder()
+				r := httptest.NewRequest(http.MethodConnect, originURL.Host, nil)
+				h.ServeHTTP(w, r)
+				assert.Equal(t, http.StatusOK, w.Code)
+			}
+			assert.Equal(t, BreakerOpen, h.Breakers.State(proxy1URL("proxy1", "proxy1")))
+		})
+
+		t.Run("relay last", func(t *testing.T) {
+			proxy1Status = http.StatusServiceUnavailable
+			proxy2Status = http.StatusTooManyRequests
+			defer func() {
+				proxy1Status = http.StatusOK
+				proxy2Status = http.StatusOK
+			}()
+
+			var c MockCallback
+			c.On("OnConnect", mock.AnythingOfType("*http.Request"), proxy1URL("proxy1", "proxy1"), mock.MatchedBy(func(err error) bool {
+				e, ok := err.(*unsuccessfulStatusError)
+				if !ok {
+					return false
+				}
+
+				return e.statusCode == http.StatusServiceUnavailable
+			})).Return()
+			c.On("OnConnect", mock.AnythingOfType("*http.Request"), proxy2URL("proxy2", "proxy2"), mock.MatchedBy(func(err error) bool {
+				e, ok := err.(*unsuccessfulStatusError)
+				if !ok {
+					return false
+				}
+
+				return e.statusCode == http.StatusTooManyRequests
+			})).Return()
+			defer c.AssertExpectations(t)
+
+			h := Proxy{
+				Backends:     []string{proxy1URL("proxy1", "proxy1"), proxy2URL("proxy2", "proxy2")},
+				WriteError:   RelayLast,
+				OnConnect:    c.OnConnect,
+				OnDisconnect: c.OnDisconnect,
+			}
+
+			w := newRecorder()
+			r := httptest.NewRequest(http.MethodConnect, originURL.Host, nil)
+			h.ServeHTTP(w, r)
+			assert.Equal(t, http.StatusTooManyRequests, w.Code)
+		})
+
+		t.Run("OK with health check", func(t *testing.T) {
+			var c MockCallback
+			c.On("OnConnect", mock.AnythingOfType("*http.Request"), proxy1URL("proxy1", "proxy1"), ErrUnhealthy).Return()
+			c.On("OnConnect", mock.AnythingOfType("*http.Request"), proxy2URL("proxy2", "proxy2"), nil).Return()
+			c.On("OnDisconnect", int64(0), int64(0)).Return()
+			defer c.AssertExpectations(t)
+
+			var hc HealthCheck
+			hc.watch(proxy1URL("proxy1", "proxy1"))
+			hc.states[proxy1URL("proxy1", "proxy1")].unhealthy = true
+
+			h := Proxy{
+				Backends:     []string{proxy1URL("proxy1", "proxy1"), proxy2URL("proxy2", "proxy2")},
+				HealthCheck:  &hc,
+				OnConnect:    c.OnConnect,
+				OnDisconnect: c.OnDisconnect,
+			}
+
+			w := newRecorder()
+			r := httptest.NewRequest(http.MethodConnect, originURL.Host, nil)
+			h.ServeHTTP(w, r)
+			assert.Equal(t, http.StatusOK, w.Code)
+		})
+
+		t.Run("deadline", func(t *testing.T) {
+			slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				<-r.Context().Done()
+			}))
+			defer slow.Close()
+
+			var c MockCallback
+			c.On("OnConnect", mock.AnythingOfType("*http.Request"), slow.URL, context.DeadlineExceeded).Return()
+			defer c.AssertExpectations(t)
+
+			h := Proxy{
+				Backends:     []string{slow.URL, proxy2URL("proxy2", "proxy2")},
+				Deadline:     10 * time.Millisecond,
+				OnConnect:    c.OnConnect,
+				OnDisconnect: c.OnDisconnect,
+			}
+
+			w := newRecorder()
+			r := httptest.NewRequest(http.MethodConnect, originURL.Host, nil)
+			h.ServeHTTP(w, r)
+			assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+		})
+
+		t.Run("timeout", func(t *testing.T) {
+			l, err := net.Listen("tcp", ":0")
+			assert.NoError(t, err)
+			defer func() {
+				assert.NoError(t, l.Close())
+			}()
+
+			go func() {
+				var conns []net.Conn
+				defer func() {
+					for _, c := range conns {
+						_ = c.Close()
+					}
+				}()
+				for {
+					conn, err := l.Accept()
+					if err != nil {
+						return
+					}
+					conns = append(conns, conn)
+				}
+			}()
+
+			var c MockCallback
+			c.On("OnConnect", mock.AnythingOfType("*http.Request"), fmt.Sprintf("http://%s/", l.Addr()), context.DeadlineExceeded).Return()
+			defer c.AssertExpectations(t)
+
+			h := Proxy{
+				Backends:     []string{fmt.Sprintf("http://%s/", l.Addr())},
+				Timeout:      10 * time.Millisecond,
+				OnConnect:    c.OnConnect,
+				OnDisconnect: c.OnDisconnect,
+			}
+
+			w := newRecorder()
+			r := httptest.NewRequest(http.MethodConnect, originURL.Host, nil)
+			h.ServeHTTP(w, r)
+			assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+		})
+
+		t.Run("max attempts", func(t *testing.T) {
+			proxy1Status = http.StatusServiceUnavailable
+			defer func() {
+				proxy1Status = http.StatusOK
+			}()
+
+			var c MockCallback
+			c.On("OnConnect", mock.AnythingOfType("*http.Request"), proxy1URL("proxy1", "proxy1"), mock.MatchedBy(func(err error) bool {
+				e, ok := err.(*unsuccessfulStatusError)
+				if !ok {
+					return false
+				}
+
+				return e.statusCode == http.StatusServiceUnavailable
+			})).Return()
+			defer c.AssertExpectations(t)
+
+			h := Proxy{
+				Backends:     []string{proxy1URL("proxy1", "proxy1"), proxy2URL("proxy2", "proxy2")},
+				MaxAttempts:  1,
+				OnConnect:    c.OnConnect,
+				OnDisconnect: c.OnDisconnect,
+			}
+
+			w := newRecorder()
+			r := httptest.NewRequest(http.MethodConnect, originURL.Host, nil)
+			h.ServeHTTP(w, r)
+			assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+			assert.Contains(t, w.Body.String(), "max attempts exhausted")
+		})
+
+		t.Run("retry budget", func(t *testing.T) {
+			proxy1Status = http.StatusServiceUnavailable
+			defer func() {
+				proxy1Status = http.StatusOK
+			}()
+
+			var c MockCallback
+			c.On("OnConnect", mock.AnythingOfType("*http.Request"), proxy1URL("proxy1", "proxy1"), mock.MatchedBy(func(err error) bool {
+				e, ok := err.(*unsuccessfulStatusError)
+				if !ok {
+					return false
+				}
+
+				return e.statusCode == http.StatusServiceUnavailable
+			})).Return()
+			defer c.AssertExpectations(t)
+
+			h := Proxy{
+				Backends:     []string{proxy1URL("proxy1", "proxy1"), proxy2URL("proxy2", "proxy2")},
+				RetryBudget:  &RetryBudget{MinPerSecond: 0.001},
+				OnConnect:    c.OnConnect,
+				OnDisconnect: c.OnDisconnect,
+			}
+
+			w := newRecorder()
+			r := httptest.NewRequest(http.MethodConnect, originURL.Host, nil)
+			h.ServeHTTP(w, r)
+			assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+			assert.Contains(t, w.Body.String(), "retry budget exhausted")
+			assert.InDelta(t, 0.2, h.RetryBudget.Tokens(), 0.01)
+		})
+
+		t.Run("retry budget with half-open circuit", func(t *testing.T) {
+			proxy1Status = http.StatusServiceUnavailable
+			defer func() {
+				proxy1Status = http.StatusOK
+			}()
+
+			var c MockCallback
+			c.On("OnConnect", mock.AnythingOfType("*http.Request"), proxy1URL("proxy1", "proxy1"), mock.MatchedBy(func(err error) bool {
+				e, ok := err.(*unsuccessfulStatusError)
+				if !ok {
+					return false
+				}
+
+				return e.statusCode == http.StatusServiceUnavailable
+			})).Return()
+			defer c.AssertExpectations(t)
+
+			h := Proxy{
+				Backends:     []string{proxy1URL("proxy1", "proxy1"), proxy2URL("proxy2", "proxy2")},
+				Breakers:     &Breakers{CoolDown: time.Nanosecond},
+				RetryBudget:  &RetryBudget{MinPerSecond: 0.001},
+				OnConnect:    c.OnConnect,
+				OnDisconnect: c.OnDisconnect,
+			}
+			h.Breakers.trip(proxy2URL("proxy2", "proxy2"))
+
+			w := newRecorder()
+			r := httptest.NewRequest(http.MethodConnect, originURL.Host, nil)
+			h.ServeHTTP(w, r)
+			assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+			assert.Contains(t, w.Body.String(), "retry budget exhausted")
+
+			// The denied trial doesn't hold the half-open circuit.
+			assert.Equal(t, BreakerHalfOpen, h.Breakers.State(proxy2URL("proxy2", "proxy2")))
+			assert.True(t, h.Breakers.allow(proxy2URL("proxy2", "proxy2")))
+		})
+
+		t.Run("OK with retries", func(t *testing.T) {
+			var c MockCallback
+			c.On("OnConnect", mock.AnythingOfType("*http.Request"), proxy1URL("proxy1", "proxy1"), mock.MatchedBy(func(err error) bool {
+				e, ok := err.(*unsuccessfulStatusError)
+				if !ok {
+					return false
+				}
+
+				return e.statusCode == http.StatusServiceUnavailable
+			})).Run(func(mock.Arguments) {
+				proxy1Status = http.StatusOK
+			}).Return().Once()
+			c.On("OnConnect", mock.AnythingOfType("*http.Request"), proxy1URL("proxy1", "proxy1"), nil).Return().Once()
+			c.On("OnDisconnect", int64(0), int64(0)).Return()
+			defer c.AssertExpectations(t)
+
+			proxy1Status = http.StatusServiceUnavailable
+			defer func() {
+				proxy1Status = http.StatusOK
+			}()
+
+			h := Proxy{
+				Backends:     []string{proxy1URL("proxy1", "proxy1")},
+				Retries:      1,
+				RetryBackoff: time.Millisecond,
+				OnConnect:    c.OnConnect,
+				OnDisconnect: c.OnDisconnect,
+			}
+
+			w := newRecorder()
+			r := httptest.NewRequest(http.MethodConnect, originURL.Host, nil)
+			h.ServeHTTP(w, r)
+			assert.Equal(t, http.StatusOK, w.Code)
+		})
+
 		t.Run("auth error", func(t *testing.T) {
 			var c MockCallback
 			c.On("OnConnect", mock.AnythingOfType("*http.Request"), proxy1URL("invalid", "invalid"), mock.MatchedBy(func(err error) bool {
@@ -276,6 +908,158 @@ func TestProxies_ServeHTTP(t *testing.T) {
 		})
 	})
 
+	t.Run("forward", func(t *testing.T) {
+		// A backend HTTP proxy which echoes the request.
+		proxy1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if credentials(r) != "proxy1:proxy1" {
+				w.WriteHeader(http.StatusProxyAuthRequired)
+				return
+			}
+			b, err := ioutil.ReadAll(r.Body)
+			assert.NoError(t, err)
+			w.Header().Set("X-Proxy", "proxy1")
+			_, _ = fmt.Fprintf(w, "%s %s %s", r.Method, r.URL, b)
+		}))
+		defer proxy1.Close()
+		proxy1URL := func(username, password string) string {
+			u, err := url.Parse(proxy1.URL)
+			assert.NoError(t, err)
+			u.User = url.UserPassword(username, password)
+			return u.String()
+		}
+
+		// A backend HTTP proxy which accepts connections but closes them without responses.
+		l, err := net.Listen("tcp", ":0")
+		assert.NoError(t, err)
+		defer func() {
+			assert.NoError(t, l.Close())
+		}()
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				_, _ = http.ReadRequest(bufio.NewReader(conn))
+				assert.NoError(t, conn.Close())
+			}
+		}()
+		broken := fmt.Sprintf("http://%s/", l.Addr())
+
+		// A backend HTTP proxy which refuses connections.
+		refused := func() string {
+			l, err := net.Listen("tcp", ":0")
+			assert.NoError(t, err)
+			assert.NoError(t, l.Close())
+			return fmt.Sprintf("http://%s/", l.Addr())
+		}()
+
+		t.Run("OK", func(t *testing.T) {
+			var c MockCallback
+			c.On("OnConnect", mock.AnythingOfType("*http.Request"), proxy1URL("proxy1", "proxy1"), nil).Return()
+			c.On("OnDisconnect", int64(27), int64(0)).Return()
+			defer c.AssertExpectations(t)
+
+			h := Proxy{
+				Backends:     []string{proxy1URL("proxy1", "proxy1")},
+				OnConnect:    c.OnConnect,
+				OnDisconnect: c.OnDisconnect,
+			}
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "http://example.com/foo", nil)
+			h.ServeHTTP(w, r)
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, "proxy1", w.Header().Get("X-Proxy"))
+			assert.Contains(t, w.Header().Get("Proxy-Status"), "httpproxyfailover; next-hop=")
+			assert.Equal(t, "GET http://example.com/foo ", w.Body.String())
+		})
+
+		t.Run("OK without tunnels or latencies", func(t *testing.T) {
+			var tunnels Tunnels
+			var latencies Latencies
+			var live map[string]int
+
+			h := Proxy{
+				Backends:  []string{proxy1URL("proxy1", "proxy1")},
+				Tunnels:   &tunnels,
+				Latencies: &latencies,
+				OnDisconnect: func(read, wrote int64) {
+					live = tunnels.Counts()
+				},
+			}
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "http://example.com/foo", nil)
+			h.ServeHTTP(w, r)
+			assert.Equal(t, http.StatusOK, w.Code)
+
+			// They're only for CONNECT requests.
+			assert.Empty(t, live)
+			assert.Empty(t, latencies.Averages())
+		})
+
+		t.Run("OK with idempotent request after failure", func(t *testing.T) {
+			var c MockCallback
+			c.On("OnConnect", mock.AnythingOfType("*http.Request"), broken, io.ErrUnexpectedEOF).Return()
+			c.On("OnConnect", mock.AnythingOfType("*http.Request"), proxy1URL("proxy1", "proxy1"), nil).Return()
+			c.On("OnDisconnect", int64(30), int64(3)).Return()
+			defer c.AssertExpectations(t)
+
+			h := Proxy{
+				Backends:     []string{broken, proxy1URL("proxy1", "proxy1")},
+				OnConnect:    c.OnConnect,
+				OnDisconnect: c.OnDisconnect,
+			}
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPut, "http://example.com/foo", strings.NewReader("bar"))
+			h.ServeHTTP(w, r)
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, "PUT http://example.com/foo bar", w.Body.String())
+		})
+
+		t.Run("OK with non-idempotent request after connection failure", func(t *testing.T) {
+			var c MockCallback
+			c.On("OnConnect", mock.AnythingOfType("*http.Request"), refused, mock.MatchedBy(func(err error) bool {
+				_, ok := err.(*net.OpError)
+				return ok
+			})).Return()
+			c.On("OnConnect", mock.AnythingOfType("*http.Request"), proxy1URL("proxy1", "proxy1"), nil).Return()
+			c.On("OnDisconnect", int64(31), int64(3)).Return()
+			defer c.AssertExpectations(t)
+
+			h := Proxy{
+				Backends:     []string{refused, proxy1URL("proxy1", "proxy1")},
+				OnConnect:    c.OnConnect,
+				OnDisconnect: c.OnDisconnect,
+			}
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "http://example.com/foo", strings.NewReader("bar"))
+			h.ServeHTTP(w, r)
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, "POST http://example.com/foo bar", w.Body.String())
+		})
+
+		t.Run("non-idempotent request after failure", func(t *testing.T) {
+			var c MockCallback
+			c.On("OnConnect", mock.AnythingOfType("*http.Request"), broken, io.ErrUnexpectedEOF).Return()
+			defer c.AssertExpectations(t)
+
+			h := Proxy{
+				Backends:     []string{broken, proxy1URL("proxy1", "proxy1")},
+				OnConnect:    c.OnConnect,
+				OnDisconnect: c.OnDisconnect,
+			}
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "http://example.com/foo", strings.NewReader("bar"))
+			h.ServeHTTP(w, r)
+			assert.Equal(t, http.StatusBadGateway, w.Code)
+		})
+	})
+
 	t.Run("Other methods", func(t *testing.T) {
 		var c MockCallback
 		defer c.AssertExpectations(t)
@@ -595,6 +1379,235 @@ func TestProxy_EnableTemplates(t *testing.T) {
 		}
 		assert.Error(t, h.EnableTemplates())
 	})
+
+	t.Run("annotations", func(t *testing.T) {
+		h := Proxy{
+			Backends: []string{
+				"http://proxy1.example.com:8080 weight=70",
+				"{fast}http://proxy2.example.com:8080  weight=20 tier=2",
+				"http://proxy3.example.com:8080",
+			},
+		}
+		assert.NoError(t, h.EnableTemplates())
+
+		r := httptest.NewRequest(http.MethodConnect, "example.com:443", nil)
+		r.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("fast")))
+		backends, err := h.applicableBackends(r)
+		assert.NoError(t, err)
+		assert.Equal(t, []Backend{
+			{URL: "http://proxy1.example.com:8080", Weight: 70},
+			{URL: "http://proxy2.example.com:8080", Weight: 20, Tier: 2},
+			{URL: "http://proxy3.example.com:8080", Weight: 1},
+		}, backends)
+	})
+
+	t.Run("invalid annotations", func(t *testing.T) {
+		for _, b := range []string{
+			"http://proxy1.example.com:8080 weight",
+			"http://proxy1.example.com:8080 weight=heavy",
+			"http://proxy1.example.com:8080 weight=0",
+			"http://proxy1.example.com:8080 tier=premium",
+			"http://proxy1.example.com:8080 unknown=1",
+		} {
+			h := Proxy{
+				Backends: []string{b},
+			}
+			assert.Error(t, h.EnableTemplates(), b)
+		}
+	})
+}
+
+func TestProxy_order(t *testing.T) {
+	r := httptest.NewRequest(http.MethodConnect, "example.com:443", nil)
+	bs := []Backend{
+		{URL: "a", Weight: 1, Tier: 1},
+		{URL: "b", Weight: 1, Tier: 0},
+		{URL: "c", Weight: 1, Tier: 1},
+		{URL: "d", Weight: 1, Tier: 0},
+		{URL: "e", Weight: 1, Tier: 2},
+	}
+
+	t.Run("default", func(t *testing.T) {
+		var p Proxy
+		assert.Equal(t, []Backend{
+			{URL: "b", Weight: 1, Tier: 0},
+			{URL: "d", Weight: 1, Tier: 0},
+			{URL: "a", Weight: 1, Tier: 1},
+			{URL: "c", Weight: 1, Tier: 1},
+			{URL: "e", Weight: 1, Tier: 2},
+		}, p.order(r, bs))
+	})
+
+	t.Run("selectors", func(t *testing.T) {
+		p := Proxy{
+			Selector: &RoundRobin{},
+			Tiers: map[int]Selector{
+				1: InOrder{},
+			},
+		}
+		assert.Equal(t, []Backend{
+			{URL: "b", Weight: 1, Tier: 0},
+			{URL: "d", Weight: 1, Tier: 0},
+			{URL: "a", Weight: 1, Tier: 1},
+			{URL: "c", Weight: 1, Tier: 1},
+			{URL: "e", Weight: 1, Tier: 2},
+		}, p.order(r, bs))
+		assert.Equal(t, []Backend{
+			{URL: "d", Weight: 1, Tier: 0},
+			{URL: "b", Weight: 1, Tier: 0},
+			{URL: "a", Weight: 1, Tier: 1},
+			{URL: "c", Weight: 1, Tier: 1},
+			{URL: "e", Weight: 1, Tier: 2},
+		}, p.order(r, bs))
+	})
+
+	t.Run("round-robin tiers", func(t *testing.T) {
+		p := Proxy{
+			Selector: &RoundRobin{},
+		}
+		bs := []Backend{
+			{URL: "a", Weight: 1, Tier: 0},
+			{URL: "b", Weight: 1, Tier: 0},
+			{URL: "c", Weight: 1, Tier: 1},
+			{URL: "d", Weight: 1, Tier: 1},
+		}
+
+		// Each tier rotates on its own.
+		var firsts []string
+		for i := 0; i < 4; i++ {
+			ret := p.order(r, bs)
+			firsts = append(firsts, ret[0].URL+ret[2].URL)
+		}
+		assert.Equal(t, []string{"ac", "bd", "ac", "bd"}, firsts)
+	})
+
+	t.Run("sessions", func(t *testing.T) {
+		p := Proxy{
+			Sessions: &Sessions{Key: "session"},
+		}
+		r := httptest.NewRequest(http.MethodConnect, "example.com:443", nil)
+		r.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("session=abc123:")))
+
+		// The pinned backend comes first only in its tier.
+		p.Sessions.pin(r, "c")
+		assert.Equal(t, []Backend{
+			{URL: "b", Weight: 1, Tier: 0},
+			{URL: "d", Weight: 1, Tier: 0},
+			{URL: "c", Weight: 1, Tier: 1},
+			{URL: "a", Weight: 1, Tier: 1},
+			{URL: "e", Weight: 1, Tier: 2},
+		}, p.order(r, bs))
+	})
+}
+
+func TestProxy_try(t *testing.T) {
+	r := httptest.NewRequest(http.MethodConnect, "example.com:443", nil)
+	bs := []Backend{
+		{URL: "a", Weight: 1, Tier: 0},
+		{URL: "b", Weight: 1, Tier: 0},
+		{URL: "c", Weight: 1, Tier: 1},
+	}
+
+	// The backends in tier 0 fail after a while, and the one in tier 1 succeeds.
+	trialFunc := func(done chan string) trialFunc {
+		return func(ctx context.Context, b Backend) trial {
+			if b.Tier == 0 {
+				time.Sleep(20 * time.Millisecond)
+				done <- b.URL
+				return trial{backend: b, err: errors.New("failed")}
+			}
+			close(done)
+			return trial{backend: b}
+		}
+	}
+
+	for name, p := range map[string]Proxy{
+		"race":  {Race: 3},
+		"hedge": {HedgeDelay: time.Millisecond},
+	} {
+		t.Run(name, func(t *testing.T) {
+			p.OnConnect = func(*http.Request, string, error) {}
+
+			// Tier 1 isn't tried until both of the backends in tier 0 finish.
+			done := make(chan string, 3)
+			tr, failures, err := p.try(r, bs, trialFunc(done))
+			assert.NoError(t, err)
+			assert.Equal(t, "c", tr.backend.URL)
+			assert.Len(t, failures, 2)
+			var finished []string
+			for b := range done {
+				finished = append(finished, b)
+			}
+			assert.ElementsMatch(t, []string{"a", "b"}, finished)
+		})
+	}
+}
+
+func TestProxy_available(t *testing.T) {
+	p := Proxy{
+		Breakers: &Breakers{Threshold: 1, CoolDown: 10 * time.Millisecond},
+		Outliers: &Outliers{},
+	}
+	p.Breakers.record("a", errors.New("failed"))
+	p.Outliers.outliers = map[string]*outlier{
+		"a": {until: time.Now().Add(30 * time.Millisecond)},
+	}
+
+	// The ejection doesn't take the trial of the half-open circuit.
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, ErrEjected, p.available("a"))
+	assert.Equal(t, BreakerOpen, p.Breakers.State("a"))
+
+	time.Sleep(20 * time.Millisecond)
+	assert.NoError(t, p.available("a"))
+	assert.Equal(t, BreakerHalfOpen, p.Breakers.State("a"))
+	assert.Equal(t, ErrCircuitOpen, p.available("a"))
+}
+
+func TestProxy_backoff(t *testing.T) {
+	p := Proxy{
+		RetryBackoff:    100 * time.Millisecond,
+		MaxRetryBackoff: time.Second,
+	}
+	for i, max := range []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second,
+		time.Second,
+	} {
+		d := p.backoff(i)
+		assert.True(t, d >= max/2, d)
+		assert.True(t, d <= max, d)
+	}
+}
+
+func TestTrialBackend(t *testing.T) {
+	r := httptest.NewRequest(http.MethodConnect, "example.com:443", nil)
+	_, ok := TrialBackend(r)
+	assert.False(t, ok)
+
+	b, ok := TrialBackend(withTrialBackend(r, Backend{URL: "a", Weight: 1, Tier: 2}))
+	assert.True(t, ok)
+	assert.Equal(t, Backend{URL: "a", Weight: 1, Tier: 2}, b)
+}
+
+func TestInbound(t *testing.T) {
+	t.Run("canceled while dialing", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		defer func() {
+			assert.NoError(t, l.Close())
+		}()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		connect := httptest.NewRequest(http.MethodConnect, "example.com:443", nil)
+		_, _, err = inbound(ctx, connect, "http://"+l.Addr().String())
+		assert.Equal(t, context.Canceled, err)
+	})
 }
 
 type recorder struct {
@@ -0,0 +1,168 @@
+package httpproxyfailover
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// defaultName is the name of Proxy in Proxy-Status header if Proxy.Name is not provided.
+const defaultName = "httpproxyfailover"
+
+// proxyStatus returns the value of Proxy-Status header (RFC 9209) for the trial of the backend HTTP proxy.
+// backend is empty if there's no trial.
+func (p *Proxy) proxyStatus(backend string, err error) string {
+	var b strings.Builder
+	b.WriteString(sfItem(p.name()))
+	if backend != "" {
+		if u, err := urlParse(backend); err == nil {
+			_, _ = fmt.Fprintf(&b, "; next-hop=%s", sfString(u.Host))
+		}
+	}
+	if err != nil {
+		_, _ = fmt.Fprintf(&b, "; error=%s", proxyErrorType(err))
+		if code, ok := StatusCode(err); ok {
+			_, _ = fmt.Fprintf(&b, "; received-status=%d", code)
+		}
+		_, _ = fmt.Fprintf(&b, "; details=%s", sfString(err.Error()))
+	}
+	return b.String()
+}
+
+func (p *Proxy) name() string {
+	if p.Name == "" {
+		return defaultName
+	}
+	return p.Name
+}
+
+// proxyErrorType returns the proxy error type (RFC 9209) for the error.
+func proxyErrorType(err error) string {
+	var typed *typedError
+	if errors.As(err, &typed) {
+		return typed.errorType
+	}
+
+	if code, ok := StatusCode(err); ok {
+		if code/100 == 4 {
+			return "http_request_denied"
+		}
+		return "destination_unavailable"
+	}
+
+	var replyErr *socksReplyError
+	if errors.As(err, &replyErr) {
+		switch replyErr.code {
+		case 0x02:
+			return "destination_ip_prohibited"
+		case 0x03, 0x04:
+			return "destination_ip_unroutable"
+		default:
+			return "destination_unavailable"
+		}
+	}
+	if errors.Is(err, errSOCKSAuth) {
+		return "http_request_denied"
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		if dnsErr.IsTimeout {
+			return "dns_timeout"
+		}
+		return "dns_error"
+	}
+
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection_refused"
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "connection_terminated"
+	case errors.Is(err, ErrInvalidProxyAuthorization):
+		return "http_request_error"
+	case errors.Is(err, ErrProxyAuthRequired):
+		return "http_request_denied"
+	case errors.Is(err, ErrNoApplicableBackend):
+		return "destination_not_found"
+	case errors.Is(err, ErrRetryBudgetExhausted):
+		return "connection_limit_reached"
+	}
+
+	var unknownAuthority x509.UnknownAuthorityError
+	var invalid x509.CertificateInvalidError
+	var hostname x509.HostnameError
+	if errors.As(err, &unknownAuthority) || errors.As(err, &invalid) || errors.As(err, &hostname) {
+		return "tls_certificate_error"
+	}
+
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrTimeout) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return "connection_timeout"
+	}
+
+	var recordHeader tls.RecordHeaderError
+	switch {
+	case strings.Contains(err.Error(), "remote error: tls: "):
+		return "tls_alert_received"
+	case errors.As(err, &recordHeader), strings.Contains(err.Error(), "tls: "):
+		return "tls_protocol_error"
+	}
+
+	return "destination_unavailable"
+}
+
+// typedError is an error with an explicit proxy error type (RFC 9209).
+type typedError struct {
+	errorType string
+	err       error
+}
+
+func (err *typedError) Error() string {
+	return err.err.Error()
+}
+
+func (err *typedError) Unwrap() error {
+	return err.err
+}
+
+// sfItem returns s as a structured field token (RFC 8941) if possible, otherwise as a string.
+func sfItem(s string) string {
+	if s == "" || !(s[0] == '*' || ('a' <= s[0] && s[0] <= 'z') || ('A' <= s[0] && s[0] <= 'Z')) {
+		return sfString(s)
+	}
+	for _, c := range []byte(s) {
+		if !isTchar(c) && c != ':' && c != '/' {
+			return sfString(s)
+		}
+	}
+	return s
+}
+
+func isTchar(c byte) bool {
+	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') || strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
+
+// sfString returns s as a structured field string (RFC 8941). Characters not allowed in it are replaced with '?'.
+func sfString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, c := range []byte(s) {
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c > 0x7e:
+			b.WriteByte('?')
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
@@ -0,0 +1,88 @@
+package httpproxyfailover
+
+import (
+	"sync"
+	"time"
+)
+
+// RetryBudget caps trials beyond the first one for each CONNECT request at a percentage of recent CONNECT requests.
+// It's a token bucket. Each CONNECT request deposits Percent/100 tokens, and each extra trial withdraws 1 token.
+// Proxy stops failing over once the bucket runs out of tokens. The bucket starts with MinPerSecond tokens so that a
+// freshly started Proxy can fail over.
+type RetryBudget struct {
+	// Percent is the percentage of extra trials to CONNECT requests. If it's 0, 20 is used.
+	Percent float64
+
+	// MinPerSecond is the number of tokens deposited every second regardless of CONNECT requests. If it's 0, 10 is
+	// used.
+	MinPerSecond float64
+
+	// Max is the maximum number of tokens in the bucket. If it's 0, 100 is used.
+	Max float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// Tokens returns the number of tokens in the bucket.
+func (b *RetryBudget) Tokens() float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	return b.tokens
+}
+
+// deposit deposits tokens for a CONNECT request.
+func (b *RetryBudget) deposit() {
+	percent := b.Percent
+	if percent == 0 {
+		percent = 20
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	b.add(percent / 100)
+}
+
+// withdraw withdraws a token for an extra trial and reports whether it succeeded.
+func (b *RetryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// refill deposits tokens for the time elapsed. b.mu has to be locked.
+func (b *RetryBudget) refill() {
+	minPerSecond := b.MinPerSecond
+	if minPerSecond == 0 {
+		minPerSecond = 10
+	}
+
+	now := time.Now()
+	if b.last.IsZero() {
+		b.add(minPerSecond)
+	} else {
+		b.add(minPerSecond * now.Sub(b.last).Seconds())
+	}
+	b.last = now
+}
+
+// add adds tokens up to Max. b.mu has to be locked.
+func (b *RetryBudget) add(tokens float64) {
+	max := b.Max
+	if max == 0 {
+		max = 100
+	}
+
+	b.tokens += tokens
+	if b.tokens > max {
+		b.tokens = max
+	}
+}
@@ -0,0 +1,47 @@
+package httpproxyfailover
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryBudget(t *testing.T) {
+	b := RetryBudget{
+		Percent:      50,
+		MinPerSecond: 0.001,
+		Max:          2,
+	}
+	assert.InDelta(t, 0, b.Tokens(), 0.01)
+	assert.False(t, b.withdraw())
+
+	b.deposit()
+	assert.InDelta(t, 0.5, b.Tokens(), 0.01)
+	assert.False(t, b.withdraw())
+
+	b.deposit()
+	assert.InDelta(t, 1, b.Tokens(), 0.01)
+	assert.True(t, b.withdraw())
+	assert.InDelta(t, 0, b.Tokens(), 0.01)
+
+	// Tokens are capped at Max.
+	for i := 0; i < 10; i++ {
+		b.deposit()
+	}
+	assert.InDelta(t, 2, b.Tokens(), 0.01)
+
+	// It starts with MinPerSecond tokens.
+	b = RetryBudget{}
+	assert.InDelta(t, 10, b.Tokens(), 0.01)
+
+	// Tokens are refilled over time.
+	b = RetryBudget{
+		MinPerSecond: 100,
+		Max:          1,
+	}
+	assert.True(t, b.withdraw())
+	assert.False(t, b.withdraw())
+	time.Sleep(20 * time.Millisecond)
+	assert.True(t, b.withdraw())
+}
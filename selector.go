@@ -0,0 +1,272 @@
+package httpproxyfailover
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Selector decides the order in which Proxy tries the applicable backends for a CONNECT request.
+// Proxy fails over to the next backend in the returned slice just like it does for the original order.
+type Selector interface {
+	Select(connect *http.Request, backends []Backend) []Backend
+}
+
+// InOrder is a Selector which keeps backends in order of Proxy.Backends.
+type InOrder struct{}
+
+// Select returns backends as they are.
+func (InOrder) Select(_ *http.Request, backends []Backend) []Backend {
+	return backends
+}
+
+// RoundRobin is a Selector which rotates the starting backend for every CONNECT request.
+// It keeps a separate rotation for each set of backends so that tiers sharing it rotate independently.
+type RoundRobin struct {
+	mu   sync.Mutex
+	next map[string]int
+}
+
+// maxRotations is the number of rotations RoundRobin keeps before it starts over.
+const maxRotations = 64
+
+// Select returns backends rotated by the number of preceding calls for the same backends.
+func (s *RoundRobin) Select(_ *http.Request, backends []Backend) []Backend {
+	if len(backends) == 0 {
+		return backends
+	}
+
+	var k strings.Builder
+	for _, b := range backends {
+		k.WriteString(b.URL)
+		k.WriteString("\x00")
+	}
+	key := k.String()
+
+	s.mu.Lock()
+	if _, ok := s.next[key]; !ok && (s.next == nil || len(s.next) >= maxRotations) {
+		s.next = map[string]int{}
+	}
+	n := s.next[key] % len(backends)
+	s.next[key] = n + 1
+	s.mu.Unlock()
+
+	ret := make([]Backend, 0, len(backends))
+	ret = append(ret, backends[n:]...)
+	ret = append(ret, backends[:n]...)
+	return ret
+}
+
+// Random is a Selector which shuffles backends uniformly at random for every CONNECT request.
+type Random struct{}
+
+// Select returns a shuffled copy of backends.
+func (Random) Select(_ *http.Request, backends []Backend) []Backend {
+	ret := make([]Backend, len(backends))
+	copy(ret, backends)
+	rand.Shuffle(len(ret), func(i, j int) {
+		ret[i], ret[j] = ret[j], ret[i]
+	})
+	return ret
+}
+
+// WeightedRandom is a Selector which shuffles backends at random in proportion to their weights.
+// The first backend is chosen with the probability of its weight divided by the sum of all the weights, and so is
+// the next one out of the rest of the backends.
+type WeightedRandom struct{}
+
+// Select returns a copy of backends shuffled by weight.
+func (WeightedRandom) Select(_ *http.Request, backends []Backend) []Backend {
+	rest := make([]Backend, len(backends))
+	copy(rest, backends)
+
+	var sum int
+	for _, b := range rest {
+		sum += b.Weight
+	}
+
+	ret := make([]Backend, 0, len(backends))
+	for len(rest) > 0 {
+		i := pickWeighted(rest, sum)
+		ret = append(ret, rest[i])
+		sum -= rest[i].Weight
+		rest = append(rest[:i], rest[i+1:]...)
+	}
+	return ret
+}
+
+func pickWeighted(backends []Backend, sum int) int {
+	if sum <= 0 {
+		return rand.Intn(len(backends))
+	}
+	n := rand.Intn(sum)
+	for i, b := range backends {
+		n -= b.Weight
+		if n < 0 {
+			return i
+		}
+	}
+	return len(backends) - 1
+}
+
+// LeastTunnels is a Selector which sorts backends by the number of live tunnels in ascending order.
+// Backends with the same number of live tunnels are shuffled.
+type LeastTunnels struct {
+	// Tunnels should be the same as Proxy.Tunnels. Otherwise, no tunnels are counted and backends are just shuffled.
+	// If it's nil, backends are shuffled like Random.
+	Tunnels *Tunnels
+}
+
+// Select returns a copy of backends sorted by the number of live tunnels.
+func (s LeastTunnels) Select(r *http.Request, backends []Backend) []Backend {
+	ret := Random{}.Select(r, backends)
+	if s.Tunnels == nil {
+		return ret
+	}
+	counts := s.Tunnels.Counts()
+	sort.SliceStable(ret, func(i, j int) bool {
+		return counts[ret[i].URL] < counts[ret[j].URL]
+	})
+	return ret
+}
+
+// PowerOfTwoChoices is a Selector which prefers backends with lower CONNECT latencies.
+// It picks two backends at random and puts the one with the lower moving average of latencies first. Then it does
+// the same for the rest of the backends. Backends without samples are preferred so that they get measured.
+type PowerOfTwoChoices struct {
+	// Latencies should be the same as Proxy.Latencies. Otherwise, no latencies are recorded and backends are just
+	// shuffled. If it's nil, backends are shuffled like Random.
+	Latencies *Latencies
+}
+
+// Select returns a copy of backends ordered by the power of two choices.
+func (s PowerOfTwoChoices) Select(r *http.Request, backends []Backend) []Backend {
+	rest := Random{}.Select(r, backends)
+	if s.Latencies == nil {
+		return rest
+	}
+	averages := s.Latencies.Averages()
+	better := func(i, j int) bool {
+		ai, ok := averages[rest[i].URL]
+		if !ok {
+			return true
+		}
+		aj, ok := averages[rest[j].URL]
+		if !ok {
+			return false
+		}
+		return ai <= aj
+	}
+
+	ret := make([]Backend, 0, len(backends))
+	for len(rest) > 1 {
+		// rest is already shuffled. So the first two are random choices.
+		i := 0
+		if !better(0, 1) {
+			i = 1
+		}
+		ret = append(ret, rest[i])
+		rest = append(rest[:i], rest[i+1:]...)
+	}
+	return append(ret, rest...)
+}
+
+// ConsistentHash is a Selector which maps the target of a CONNECT request to backends on a consistent hash ring.
+// The same target goes through the same backend as long as it's applicable, and it fails over to the next backends
+// on the ring. Adding or removing a backend only moves the targets around its points on the ring.
+// The rings are cached for the sets of applicable backends so that they're built only once.
+type ConsistentHash struct {
+	// Replicas is the number of points on the ring for each backend. The number is multiplied by the weight of the
+	// backend. If it's 0, 100 is used.
+	Replicas int
+
+	mu    sync.Mutex
+	rings map[string][]ringPoint
+}
+
+// maxRings is the number of rings ConsistentHash caches before it starts over.
+const maxRings = 64
+
+type ringPoint struct {
+	hash    uint64
+	backend int
+}
+
+// Select returns a copy of backends in order of the ring starting from the point of the CONNECT target.
+func (s *ConsistentHash) Select(r *http.Request, backends []Backend) []Backend {
+	ring := s.ring(backends)
+
+	target := r.Host
+	if target == "" {
+		target = r.RequestURI
+	}
+	h := hash(target)
+	start := sort.Search(len(ring), func(i int) bool {
+		return ring[i].hash >= h
+	})
+
+	ret := make([]Backend, 0, len(backends))
+	seen := make([]bool, len(backends))
+	for i := 0; i < len(ring) && len(ret) < len(backends); i++ {
+		p := ring[(start+i)%len(ring)]
+		if seen[p.backend] {
+			continue
+		}
+		seen[p.backend] = true
+		ret = append(ret, backends[p.backend])
+	}
+	return ret
+}
+
+// ring returns the cached ring for backends or builds a new one. The points refer to backends by their indices.
+func (s *ConsistentHash) ring(backends []Backend) []ringPoint {
+	replicas := s.Replicas
+	if replicas == 0 {
+		replicas = 100
+	}
+
+	var k strings.Builder
+	k.WriteString(strconv.Itoa(replicas))
+	for _, b := range backends {
+		k.WriteString("\x00")
+		k.WriteString(b.URL)
+		k.WriteString("#")
+		k.WriteString(strconv.Itoa(b.Weight))
+	}
+	key := k.String()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ring, ok := s.rings[key]; ok {
+		return ring
+	}
+
+	var ring []ringPoint
+	for i, b := range backends {
+		for j := 0; j < replicas*b.Weight; j++ {
+			ring = append(ring, ringPoint{
+				hash:    hash(b.URL + "#" + strconv.Itoa(j)),
+				backend: i,
+			})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		return ring[i].hash < ring[j].hash
+	})
+
+	if s.rings == nil || len(s.rings) >= maxRings {
+		s.rings = map[string][]ringPoint{}
+	}
+	s.rings[key] = ring
+	return ring
+}
+
+func hash(s string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s))
+	return h.Sum64()
+}
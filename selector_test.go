@@ -0,0 +1,152 @@
+package httpproxyfailover
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInOrder_Select(t *testing.T) {
+	r := httptest.NewRequest(http.MethodConnect, "example.com:443", nil)
+	assert.Equal(t, backends("a", "b", "c"), InOrder{}.Select(r, backends("a", "b", "c")))
+}
+
+func TestRoundRobin_Select(t *testing.T) {
+	var s RoundRobin
+	r := httptest.NewRequest(http.MethodConnect, "example.com:443", nil)
+	bs := backends("a", "b", "c")
+	assert.Equal(t, backends("a", "b", "c"), s.Select(r, bs))
+	assert.Equal(t, backends("b", "c", "a"), s.Select(r, bs))
+	assert.Equal(t, backends("c", "a", "b"), s.Select(r, bs))
+	assert.Equal(t, backends("a", "b", "c"), s.Select(r, bs))
+	assert.Equal(t, backends("a", "b", "c"), bs)
+	assert.Empty(t, s.Select(r, nil))
+
+	// Another set of backends has its own rotation.
+	assert.Equal(t, backends("d", "e"), s.Select(r, backends("d", "e")))
+	assert.Equal(t, backends("b", "c", "a"), s.Select(r, bs))
+	assert.Equal(t, backends("e", "d"), s.Select(r, backends("d", "e")))
+}
+
+func TestRandom_Select(t *testing.T) {
+	r := httptest.NewRequest(http.MethodConnect, "example.com:443", nil)
+	bs := backends("a", "b", "c")
+	assert.ElementsMatch(t, bs, Random{}.Select(r, bs))
+	assert.Equal(t, backends("a", "b", "c"), bs)
+}
+
+func TestWeightedRandom_Select(t *testing.T) {
+	r := httptest.NewRequest(http.MethodConnect, "example.com:443", nil)
+	bs := []Backend{
+		{URL: "a", Weight: 70},
+		{URL: "b", Weight: 20},
+		{URL: "c", Weight: 10},
+	}
+
+	first := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		ret := WeightedRandom{}.Select(r, bs)
+		assert.ElementsMatch(t, bs, ret)
+		first[ret[0].URL]++
+	}
+	assert.InDelta(t, 700, first["a"], 100)
+	assert.InDelta(t, 200, first["b"], 100)
+	assert.InDelta(t, 100, first["c"], 100)
+	assert.Equal(t, "a", bs[0].URL)
+}
+
+func TestLeastTunnels_Select(t *testing.T) {
+	var tunnels Tunnels
+	tunnels.open("a")
+	tunnels.open("a")
+	tunnels.open("b")
+
+	r := httptest.NewRequest(http.MethodConnect, "example.com:443", nil)
+	s := LeastTunnels{Tunnels: &tunnels}
+	assert.Equal(t, backends("c", "b", "a"), s.Select(r, backends("a", "b", "c")))
+
+	tunnels.close("a")
+	tunnels.close("a")
+	tunnels.open("c")
+	tunnels.open("c")
+	assert.Equal(t, backends("a", "b", "c"), s.Select(r, backends("a", "b", "c")))
+
+	// Without Tunnels, backends are shuffled.
+	assert.ElementsMatch(t, backends("a", "b", "c"), LeastTunnels{}.Select(r, backends("a", "b", "c")))
+}
+
+func TestPowerOfTwoChoices_Select(t *testing.T) {
+	var l Latencies
+	l.record("a", 100*time.Millisecond)
+	l.record("b", 2*time.Second)
+
+	r := httptest.NewRequest(http.MethodConnect, "example.com:443", nil)
+	s := PowerOfTwoChoices{Latencies: &l}
+	assert.Equal(t, backends("a", "b"), s.Select(r, backends("a", "b")))
+	assert.Equal(t, backends("a", "b"), s.Select(r, backends("b", "a")))
+
+	// A backend without samples always beats the others.
+	assert.Equal(t, backends("c", "b"), s.Select(r, backends("b", "c")))
+
+	last := map[string]int{}
+	for i := 0; i < 100; i++ {
+		ret := s.Select(r, backends("a", "b", "c"))
+		assert.ElementsMatch(t, backends("a", "b", "c"), ret)
+		last[ret[2].URL]++
+	}
+	assert.Equal(t, map[string]int{"b": 100}, last)
+
+	// Without Latencies, backends are shuffled.
+	assert.ElementsMatch(t, backends("a", "b", "c"), PowerOfTwoChoices{}.Select(r, backends("a", "b", "c")))
+}
+
+func TestConsistentHash_Select(t *testing.T) {
+	var s ConsistentHash
+	bs := backends("a", "b", "c", "d")
+
+	targets := make([]string, 100)
+	before := map[string]string{}
+	for i := range targets {
+		targets[i] = fmt.Sprintf("example%d.com:443", i)
+		r := httptest.NewRequest(http.MethodConnect, targets[i], nil)
+		ret := s.Select(r, bs)
+		assert.ElementsMatch(t, bs, ret)
+		assert.Equal(t, ret, s.Select(r, bs))
+		before[targets[i]] = ret[0].URL
+	}
+
+	// Removing a backend only moves the targets which used to go through it.
+	removed := backends("a", "b", "d")
+	for _, target := range targets {
+		r := httptest.NewRequest(http.MethodConnect, target, nil)
+		ret := s.Select(r, removed)
+		if before[target] == "c" {
+			full := s.Select(r, bs)
+			assert.Equal(t, full[1], ret[0])
+			continue
+		}
+		assert.Equal(t, before[target], ret[0].URL)
+	}
+
+	// The rings are built once for each set of backends.
+	assert.Len(t, s.rings, 2)
+	ring := s.ring(bs)
+	assert.Equal(t, &ring[0], &s.ring(bs)[0])
+
+	for i := 0; i < maxRings; i++ {
+		s.ring(backends(fmt.Sprintf("%d", i)))
+	}
+	assert.LessOrEqual(t, len(s.rings), maxRings)
+}
+
+func backends(urls ...string) []Backend {
+	ret := make([]Backend, len(urls))
+	for i, u := range urls {
+		ret[i] = Backend{URL: u, Weight: 1}
+	}
+	return ret
+}
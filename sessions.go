@@ -0,0 +1,95 @@
+package httpproxyfailover
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Sessions pins sessions to the backend HTTP proxies which last succeeded for them.
+// A session is identified by the value of a template variable populated from Proxy-Authorization header.
+type Sessions struct {
+	// Key is the name of the template variable which identifies a session (e.g. `session` for `session=abc123`).
+	Key string
+
+	// TTL is the duration for which a session stays pinned after the last success. If it's 0, sessions never expire.
+	TTL time.Duration
+
+	mu        sync.Mutex
+	pins      map[string]pin
+	lastSweep time.Time
+}
+
+type pin struct {
+	backend string
+	expires time.Time
+}
+
+// prefer moves the pinned backend for the session to the front if it's applicable.
+func (s *Sessions) prefer(r *http.Request, backends []Backend) []Backend {
+	id, ok := s.id(r)
+	if !ok {
+		return backends
+	}
+
+	s.mu.Lock()
+	p, ok := s.pins[id]
+	s.mu.Unlock()
+	if !ok || (!p.expires.IsZero() && time.Now().After(p.expires)) {
+		return backends
+	}
+
+	for i, b := range backends {
+		if b.URL != p.backend {
+			continue
+		}
+		ret := make([]Backend, 0, len(backends))
+		ret = append(ret, b)
+		ret = append(ret, backends[:i]...)
+		ret = append(ret, backends[i+1:]...)
+		return ret
+	}
+	return backends
+}
+
+// pin pins the session to the backend.
+func (s *Sessions) pin(r *http.Request, backend string) {
+	id, ok := s.id(r)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	var expires time.Time
+	if s.TTL != 0 {
+		expires = now.Add(s.TTL)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pins == nil {
+		s.pins = map[string]pin{}
+	}
+	s.pins[id] = pin{
+		backend: backend,
+		expires: expires,
+	}
+
+	if s.TTL != 0 && now.Sub(s.lastSweep) > s.TTL {
+		for id, p := range s.pins {
+			if now.After(p.expires) {
+				delete(s.pins, id)
+			}
+		}
+		s.lastSweep = now
+	}
+}
+
+func (s *Sessions) id(r *http.Request) (string, bool) {
+	values, err := params(r)
+	if err != nil {
+		return "", false
+	}
+	id := values.Get(s.Key).String()
+	return id, id != ""
+}
@@ -0,0 +1,54 @@
+package httpproxyfailover
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessions(t *testing.T) {
+	session := func(credentials string) *http.Request {
+		r := httptest.NewRequest(http.MethodConnect, "example.com:443", nil)
+		if credentials != "" {
+			r.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)))
+		}
+		return r
+	}
+
+	t.Run("pinned", func(t *testing.T) {
+		s := Sessions{Key: "session"}
+		assert.Equal(t, backends("a", "b", "c"), s.prefer(session("session=abc123"), backends("a", "b", "c")))
+
+		s.pin(session("session=abc123:password"), "b")
+		assert.Equal(t, backends("b", "a", "c"), s.prefer(session("session=abc123"), backends("a", "b", "c")))
+		assert.Equal(t, backends("b", "c"), s.prefer(session("session=abc123"), backends("c", "b")))
+		assert.Equal(t, backends("a", "c"), s.prefer(session("session=abc123"), backends("a", "c")))
+		assert.Equal(t, backends("a", "b", "c"), s.prefer(session("session=def456"), backends("a", "b", "c")))
+		assert.Equal(t, backends("a", "b", "c"), s.prefer(session(""), backends("a", "b", "c")))
+
+		// Fail over re-pins the session.
+		s.pin(session("session=abc123"), "c")
+		assert.Equal(t, backends("c", "a", "b"), s.prefer(session("session=abc123"), backends("a", "b", "c")))
+	})
+
+	t.Run("no session", func(t *testing.T) {
+		s := Sessions{Key: "session"}
+		s.pin(session("tag"), "b")
+		s.pin(session("session"), "b")
+		assert.Empty(t, s.pins)
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		s := Sessions{Key: "session", TTL: time.Millisecond}
+		s.pin(session("session=abc123"), "b")
+		time.Sleep(2 * time.Millisecond)
+		assert.Equal(t, backends("a", "b", "c"), s.prefer(session("session=abc123"), backends("a", "b", "c")))
+
+		s.pin(session("session=def456"), "c")
+		assert.Len(t, s.pins, 1)
+	})
+}
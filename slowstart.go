@@ -0,0 +1,92 @@
+package httpproxyfailover
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// SlowStart ramps up the share of backend HTTP proxies which are newly added or back from being skipped by
+// HealthCheck, Breakers, or Outliers. During Window, such a backend HTTP proxy keeps its position in the order of
+// trials with the probability linearly increasing from 0 to 1. Otherwise, it's moved to the end of its tier so that
+// it's still available for fail-over.
+type SlowStart struct {
+	// Window is the duration of the ramp-up. If it's 0, 30 seconds is used.
+	Window time.Duration
+
+	mu       sync.Mutex
+	backends map[string]*slowStart
+}
+
+type slowStart struct {
+	start       time.Time
+	unavailable bool
+}
+
+// Share returns the share of the backend between 0 and 1.
+func (s *SlowStart) Share(backend string) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.share(s.backend(backend))
+}
+
+// ramp moves backends in slow start to the end at random.
+func (s *SlowStart) ramp(backends []Backend) []Backend {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ret := make([]Backend, 0, len(backends))
+	var deferred []Backend
+	for _, b := range backends {
+		if rand.Float64() >= s.share(s.backend(b.URL)) {
+			deferred = append(deferred, b)
+			continue
+		}
+		ret = append(ret, b)
+	}
+	return append(ret, deferred...)
+}
+
+// observe records whether the backend is available.
+func (s *SlowStart) observe(backend string, available bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := s.backend(backend)
+	if !available {
+		b.unavailable = true
+		return
+	}
+	if b.unavailable {
+		b.unavailable = false
+		b.start = time.Now()
+	}
+}
+
+// backend returns the state of the backend. s.mu has to be locked.
+func (s *SlowStart) backend(backend string) *slowStart {
+	if s.backends == nil {
+		s.backends = map[string]*slowStart{}
+	}
+	b, ok := s.backends[backend]
+	if !ok {
+		b = &slowStart{start: time.Now()}
+		s.backends[backend] = b
+	}
+	return b
+}
+
+// share returns the share of the backend. s.mu has to be locked.
+func (s *SlowStart) share(b *slowStart) float64 {
+	if b.unavailable {
+		return 0
+	}
+	window := s.Window
+	if window == 0 {
+		window = 30 * time.Second
+	}
+	share := float64(time.Since(b.start)) / float64(window)
+	if share > 1 {
+		return 1
+	}
+	return share
+}
@@ -0,0 +1,39 @@
+package httpproxyfailover
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSlowStart(t *testing.T) {
+	s := SlowStart{Window: time.Hour}
+
+	// Newly added.
+	assert.InDelta(t, 0, s.Share("a"), 0.01)
+	s.backends["a"].start = time.Now().Add(-30 * time.Minute)
+	assert.InDelta(t, 0.5, s.Share("a"), 0.01)
+	s.backends["a"].start = time.Now().Add(-2 * time.Hour)
+	assert.Equal(t, 1.0, s.Share("a"))
+
+	// Recovered.
+	s.observe("a", true)
+	assert.Equal(t, 1.0, s.Share("a"))
+	s.observe("a", false)
+	assert.Equal(t, 0.0, s.Share("a"))
+	s.observe("a", true)
+	assert.InDelta(t, 0, s.Share("a"), 0.01)
+
+	s.backends["b"] = &slowStart{start: time.Now().Add(-2 * time.Hour)}
+	s.backends["c"] = &slowStart{start: time.Now().Add(-2 * time.Hour)}
+	assert.Equal(t, backends("b", "c", "a"), s.ramp(backends("a", "b", "c")))
+
+	first := map[string]int{}
+	s.backends["a"].start = time.Now().Add(-30 * time.Minute)
+	for i := 0; i < 1000; i++ {
+		first[s.ramp(backends("a", "b", "c"))[0].URL]++
+	}
+	assert.InDelta(t, 500, first["a"], 100)
+	assert.InDelta(t, 500, first["b"], 100)
+}
@@ -0,0 +1,293 @@
+package httpproxyfailover
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+const (
+	socks4Version = 0x04
+
+	socks4Connect = 0x01
+
+	socks4Granted  = 90
+	socks4Rejected = 91
+	socks4NoIdentd = 92
+	socks4BadUser  = 93
+)
+
+const (
+	socks5Version = 0x05
+
+	socks5NoAuth       = 0x00
+	socks5UserPass     = 0x02
+	socks5NoAcceptable = 0xff
+
+	socks5Connect = 0x01
+
+	socks5IPv4   = 0x01
+	socks5Domain = 0x03
+	socks5IPv6   = 0x04
+)
+
+// errSOCKSAuth is the error for a SOCKS backend proxy which rejected the credentials.
+var errSOCKSAuth = errors.New("socks: authentication failed")
+
+// socksReplyError is the error for a SOCKS backend proxy which failed to connect to the target.
+type socksReplyError struct {
+	code byte
+}
+
+func (err *socksReplyError) Error() string {
+	switch err.code {
+	case 0x01:
+		return "socks: general server failure"
+	case 0x02:
+		return "socks: connection not allowed by ruleset"
+	case 0x03:
+		return "socks: network unreachable"
+	case 0x04:
+		return "socks: host unreachable"
+	case 0x05:
+		return "socks: connection refused"
+	case 0x06:
+		return "socks: TTL expired"
+	case 0x07:
+		return "socks: command not supported"
+	case 0x08:
+		return "socks: address type not supported"
+	default:
+		return fmt.Sprintf("socks: unknown reply %d", err.code)
+	}
+}
+
+func isSOCKS(u *url.URL) bool {
+	switch u.Scheme {
+	case "socks4", "socks4a", "socks5", "socks5h":
+		return true
+	default:
+		return false
+	}
+}
+
+// socks establishes a tunnel to the target through the SOCKS backend proxy over conn by the version of the scheme.
+func socks(ctx context.Context, conn net.Conn, u *url.URL, target string) error {
+	switch u.Scheme {
+	case "socks4", "socks4a":
+		return socks4(ctx, conn, u, target)
+	default:
+		return socks5(ctx, conn, u, target)
+	}
+}
+
+// socks4 establishes a tunnel to the target through the SOCKS4 backend proxy over conn.
+// With `socks4` scheme, the host name of the target is resolved locally to an IPv4 address. With `socks4a` scheme,
+// it's resolved by the backend proxy. The username in the URL is sent as the user ID.
+func socks4(ctx context.Context, conn net.Conn, u *url.URL, target string) error {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return err
+	}
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port: %s", port)
+	}
+
+	ip := net.ParseIP(host)
+	switch {
+	case ip != nil:
+		if ip = ip.To4(); ip == nil {
+			return fmt.Errorf("socks: IPv6 address not supported: %s", host)
+		}
+	case u.Scheme == "socks4":
+		addrs, err := net.DefaultResolver.LookupIP(ctx, "ip4", host)
+		if err != nil {
+			return err
+		}
+		ip = addrs[0].To4()
+	}
+
+	var userID string
+	if u.User != nil {
+		userID = u.User.Username()
+	}
+
+	req := []byte{socks4Version, socks4Connect, byte(portNum >> 8), byte(portNum)}
+	if ip == nil {
+		// SOCKS4a: an invalid IP address 0.0.0.x followed by the host name after the user ID.
+		req = append(req, 0, 0, 0, 1)
+	} else {
+		req = append(req, ip...)
+	}
+	req = append(req, userID...)
+	req = append(req, 0x00)
+	if ip == nil {
+		req = append(req, host...)
+		req = append(req, 0x00)
+	}
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	var b [8]byte
+	if _, err := io.ReadFull(conn, b[:]); err != nil {
+		return err
+	}
+	if b[0] != 0x00 {
+		return fmt.Errorf("socks: unexpected version: %d", b[0])
+	}
+	switch b[1] {
+	case socks4Granted:
+		return nil
+	case socks4Rejected:
+		return &socksReplyError{code: 0x01}
+	case socks4NoIdentd, socks4BadUser:
+		return errSOCKSAuth
+	default:
+		return fmt.Errorf("socks: unexpected reply: %d", b[1])
+	}
+}
+
+// socks5 establishes a tunnel to the target through the SOCKS5 backend proxy (RFC 1928) over conn.
+// With `socks5` scheme, the host name of the target is resolved locally. With `socks5h` scheme, it's resolved by the
+// backend proxy.
+func socks5(ctx context.Context, conn net.Conn, u *url.URL, target string) error {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return err
+	}
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port: %s", port)
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil && u.Scheme == "socks5" {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return err
+		}
+		ip = addrs[0].IP
+	}
+
+	methods := []byte{socks5NoAuth}
+	if u.User != nil {
+		methods = append(methods, socks5UserPass)
+	}
+	if _, err := conn.Write(append([]byte{socks5Version, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+
+	var b [4]byte
+	if _, err := io.ReadFull(conn, b[:2]); err != nil {
+		return err
+	}
+	if b[0] != socks5Version {
+		return fmt.Errorf("socks: unexpected version: %d", b[0])
+	}
+	switch b[1] {
+	case socks5NoAuth:
+	case socks5UserPass:
+		if err := socks5Auth(conn, u.User); err != nil {
+			return err
+		}
+	case socks5NoAcceptable:
+		return errors.New("socks: no acceptable authentication methods")
+	default:
+		return fmt.Errorf("socks: unexpected authentication method: %d", b[1])
+	}
+
+	req := []byte{socks5Version, socks5Connect, 0x00}
+	switch {
+	case ip == nil:
+		if len(host) > 255 {
+			return fmt.Errorf("socks: too long host name: %s", host)
+		}
+		req = append(req, socks5Domain, byte(len(host)))
+		req = append(req, host...)
+	case ip.To4() != nil:
+		req = append(req, socks5IPv4)
+		req = append(req, ip.To4()...)
+	default:
+		req = append(req, socks5IPv6)
+		req = append(req, ip.To16()...)
+	}
+	req = append(req, byte(portNum>>8), byte(portNum))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	if _, err := io.ReadFull(conn, b[:4]); err != nil {
+		return err
+	}
+	if b[0] != socks5Version {
+		return fmt.Errorf("socks: unexpected version: %d", b[0])
+	}
+	if b[1] != 0x00 {
+		return &socksReplyError{code: b[1]}
+	}
+
+	// Discard the bound address and port.
+	var n int
+	switch b[3] {
+	case socks5IPv4:
+		n = net.IPv4len
+	case socks5IPv6:
+		n = net.IPv6len
+	case socks5Domain:
+		if _, err := io.ReadFull(conn, b[:1]); err != nil {
+			return err
+		}
+		n = int(b[0])
+	default:
+		return fmt.Errorf("socks: unexpected address type: %d", b[3])
+	}
+	_, err = io.CopyN(ioutil.Discard, conn, int64(n+2))
+	return err
+}
+
+// socks5Auth authenticates with username and password (RFC 1929).
+func socks5Auth(conn net.Conn, userinfo *url.Userinfo) error {
+	username := userinfo.Username()
+	password, _ := userinfo.Password()
+	if len(username) > 255 || len(password) > 255 {
+		return errors.New("socks: too long username or password")
+	}
+
+	req := []byte{0x01, byte(len(username))}
+	req = append(req, username...)
+	req = append(req, byte(len(password)))
+	req = append(req, password...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	var b [2]byte
+	if _, err := io.ReadFull(conn, b[:]); err != nil {
+		return err
+	}
+	if b[1] != 0x00 {
+		return errSOCKSAuth
+	}
+	return nil
+}
+
+// established is the response to a CONNECT request for a tunnel through a SOCKS backend proxy.
+func established() *http.Response {
+	return &http.Response{
+		Status:     "200 Connection established",
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Body:       http.NoBody,
+	}
+}
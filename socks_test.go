@@ -0,0 +1,359 @@
+package httpproxyfailover
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestSocks5(t *testing.T) {
+	origin := echoServer(t)
+	defer func() {
+		assert.NoError(t, origin.Close())
+	}()
+
+	backend := socks5Server(t, "user", "pass")
+	defer func() {
+		assert.NoError(t, backend.Close())
+	}()
+
+	t.Run("OK", func(t *testing.T) {
+		conn, err := net.Dial("tcp", backend.Addr().String())
+		assert.NoError(t, err)
+		defer func() {
+			assert.NoError(t, conn.Close())
+		}()
+
+		u := &url.URL{Scheme: "socks5h", User: url.UserPassword("user", "pass"), Host: backend.Addr().String()}
+		assert.NoError(t, socks5(context.Background(), conn, u, origin.Addr().String()))
+
+		_, err = conn.Write([]byte("ping"))
+		assert.NoError(t, err)
+		b := make([]byte, 4)
+		_, err = io.ReadFull(conn, b)
+		assert.NoError(t, err)
+		assert.Equal(t, "ping", string(b))
+	})
+
+	t.Run("authentication failure", func(t *testing.T) {
+		conn, err := net.Dial("tcp", backend.Addr().String())
+		assert.NoError(t, err)
+		defer func() {
+			assert.NoError(t, conn.Close())
+		}()
+
+		u := &url.URL{Scheme: "socks5", User: url.UserPassword("user", "wrong"), Host: backend.Addr().String()}
+		assert.Equal(t, errSOCKSAuth, socks5(context.Background(), conn, u, origin.Addr().String()))
+	})
+
+	t.Run("connection refused", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		assert.NoError(t, l.Close())
+
+		conn, err := net.Dial("tcp", backend.Addr().String())
+		assert.NoError(t, err)
+		defer func() {
+			assert.NoError(t, conn.Close())
+		}()
+
+		u := &url.URL{Scheme: "socks5", User: url.UserPassword("user", "pass"), Host: backend.Addr().String()}
+		assert.Equal(t, &socksReplyError{code: 0x05}, socks5(context.Background(), conn, u, l.Addr().String()))
+	})
+}
+
+func TestSocks4(t *testing.T) {
+	origin := echoServer(t)
+	defer func() {
+		assert.NoError(t, origin.Close())
+	}()
+
+	backend := socks4Server(t, "user")
+	defer func() {
+		assert.NoError(t, backend.Close())
+	}()
+
+	_, port, err := net.SplitHostPort(origin.Addr().String())
+	assert.NoError(t, err)
+
+	for _, scheme := range []string{"socks4", "socks4a"} {
+		t.Run(scheme, func(t *testing.T) {
+			conn, err := net.Dial("tcp", backend.Addr().String())
+			assert.NoError(t, err)
+			defer func() {
+				assert.NoError(t, conn.Close())
+			}()
+
+			u := &url.URL{Scheme: scheme, User: url.User("user"), Host: backend.Addr().String()}
+			assert.NoError(t, socks4(context.Background(), conn, u, net.JoinHostPort("localhost", port)))
+
+			_, err = conn.Write([]byte("ping"))
+			assert.NoError(t, err)
+			b := make([]byte, 4)
+			_, err = io.ReadFull(conn, b)
+			assert.NoError(t, err)
+			assert.Equal(t, "ping", string(b))
+		})
+	}
+
+	t.Run("user ID mismatch", func(t *testing.T) {
+		conn, err := net.Dial("tcp", backend.Addr().String())
+		assert.NoError(t, err)
+		defer func() {
+			assert.NoError(t, conn.Close())
+		}()
+
+		u := &url.URL{Scheme: "socks4a", User: url.User("wrong"), Host: backend.Addr().String()}
+		assert.Equal(t, errSOCKSAuth, socks4(context.Background(), conn, u, origin.Addr().String()))
+	})
+
+	t.Run("IPv6", func(t *testing.T) {
+		conn, err := net.Dial("tcp", backend.Addr().String())
+		assert.NoError(t, err)
+		defer func() {
+			assert.NoError(t, conn.Close())
+		}()
+
+		u := &url.URL{Scheme: "socks4a", User: url.User("user"), Host: backend.Addr().String()}
+		assert.Error(t, socks4(context.Background(), conn, u, "[::1]:443"))
+	})
+}
+
+func TestAddress(t *testing.T) {
+	for raw, addr := range map[string]string{
+		"http://localhost:8080":    "localhost:8080",
+		"https://localhost":        "localhost:443",
+		"https://localhost:8443":   "localhost:8443",
+		"socks5://localhost":       "localhost:1080",
+		"socks5h://localhost:1081": "localhost:1081",
+		"socks4://localhost":       "localhost:1080",
+		"socks4a://[::1]":          "[::1]:1080",
+	} {
+		u, err := urlParse(raw)
+		assert.NoError(t, err)
+		assert.Equal(t, addr, address(u), raw)
+	}
+}
+
+func TestSocks5_HTTP(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, "%s %s", r.Method, r.URL)
+	}))
+	defer origin.Close()
+
+	backend := socks5Server(t, "user", "pass")
+	defer func() {
+		assert.NoError(t, backend.Close())
+	}()
+	b := fmt.Sprintf("socks5://user:pass@%s", backend.Addr())
+
+	t.Run("check", func(t *testing.T) {
+		connect := httptest.NewRequest(http.MethodConnect, "example.com:443", nil)
+		assert.NoError(t, CheckGET(origin.URL)(context.Background(), connect, b))
+	})
+
+	t.Run("forward", func(t *testing.T) {
+		var c MockCallback
+		c.On("OnConnect", mock.AnythingOfType("*http.Request"), b, nil).Return()
+		c.On("OnDisconnect", int64(8), int64(0)).Return()
+		defer c.AssertExpectations(t)
+
+		h := Proxy{
+			Backends:     []string{b},
+			OnConnect:    c.OnConnect,
+			OnDisconnect: c.OnDisconnect,
+		}
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, origin.URL+"/foo", nil)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "GET /foo", w.Body.String())
+	})
+}
+
+// echoServer listens on a random port and echoes back whatever it reads.
+func echoServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() {
+					_ = conn.Close()
+				}()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l
+}
+
+// socks5Server listens on a random port and works as a SOCKS5 proxy which requires the username and the password.
+func socks5Server(t *testing.T, username, password string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSOCKS5(conn, username, password)
+		}
+	}()
+	return l
+}
+
+// socks4Server listens on a random port and works as a SOCKS4/4a proxy which requires the user ID.
+func socks4Server(t *testing.T, userID string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSOCKS4(conn, userID)
+		}
+	}()
+	return l
+}
+
+func serveSOCKS4(conn net.Conn, userID string) {
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	b := make([]byte, 8)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return
+	}
+	u, err := socks4ReadString(conn)
+	if err != nil {
+		return
+	}
+	host := net.IP(b[4:8]).String()
+	if b[4] == 0 && b[5] == 0 && b[6] == 0 {
+		if host, err = socks4ReadString(conn); err != nil {
+			return
+		}
+	}
+	if u != userID {
+		_, _ = conn.Write([]byte{0x00, 93, 0, 0, 0, 0, 0, 0})
+		return
+	}
+
+	target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(b[2])<<8|int(b[3]))))
+	if err != nil {
+		_, _ = conn.Write([]byte{0x00, 91, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer func() {
+		_ = target.Close()
+	}()
+	_, _ = conn.Write([]byte{0x00, 90, 0, 0, 0, 0, 0, 0})
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(target, conn)
+		_ = target.Close()
+	}()
+	_, _ = io.Copy(conn, target)
+	_ = conn.Close()
+	wg.Wait()
+}
+
+func serveSOCKS5(conn net.Conn, username, password string) {
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	read := func(n int) []byte {
+		b := make([]byte, n)
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return nil
+		}
+		return b
+	}
+
+	// Negotiation.
+	b := read(2)
+	if b == nil || read(int(b[1])) == nil {
+		return
+	}
+	_, _ = conn.Write([]byte{0x05, 0x02})
+
+	// Username/password authentication.
+	b = read(2)
+	if b == nil {
+		return
+	}
+	u := read(int(b[1]))
+	b = read(1)
+	if b == nil {
+		return
+	}
+	p := read(int(b[0]))
+	if string(u) != username || string(p) != password {
+		_, _ = conn.Write([]byte{0x01, 0x01})
+		return
+	}
+	_, _ = conn.Write([]byte{0x01, 0x00})
+
+	// CONNECT.
+	b = read(4)
+	if b == nil {
+		return
+	}
+	var host string
+	switch b[3] {
+	case 0x01:
+		host = net.IP(read(4)).String()
+	case 0x03:
+		n := read(1)
+		host = string(read(int(n[0])))
+	case 0x04:
+		host = net.IP(read(16)).String()
+	}
+	port := read(2)
+	addr := net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1])))
+
+	target, err := net.Dial("tcp", addr)
+	if err != nil {
+		_, _ = conn.Write([]byte{0x05, 0x05, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer func() {
+		_ = target.Close()
+	}()
+	_, _ = conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 127, 0, 0, 1, 0, 0})
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(target, conn)
+		_ = target.Close()
+	}()
+	_, _ = io.Copy(conn, target)
+	_ = conn.Close()
+	wg.Wait()
+}
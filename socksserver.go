@@ -0,0 +1,382 @@
+package httpproxyfailover
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// SOCKS is a SOCKS5 (RFC 1928) and SOCKS4/4a server which connects to the targets through the backend proxies of Proxy.
+// The username and the password of a SOCKS5 client (RFC 1929) work just like Proxy-Authorization header of a CONNECT
+// request to Proxy. Thus, the template variables are populated from the username, and so are they from the user ID of
+// a SOCKS4 client. Each connection from a SOCKS client
+// goes through the same selection, checks and fail-over as a CONNECT request, and is reported to Proxy.OnConnect and
+// Proxy.OnDisconnect with a synthetic CONNECT request.
+type SOCKS struct {
+	// Proxy holds the backend proxies and how to fail over them.
+	Proxy *Proxy
+}
+
+// Serve accepts SOCKS clients on the listener until it fails. Just like http.Server, it retries temporary errors
+// with backoff.
+func (s *SOCKS) Serve(l net.Listener) error {
+	var delay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else {
+					delay *= 2
+				}
+				if delay > time.Second {
+					delay = time.Second
+				}
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn serves a SOCKS client on the connection and closes it.
+func (s *SOCKS) ServeConn(conn net.Conn) {
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	p := *s.Proxy
+	if p.OnConnect == nil {
+		p.OnConnect = func(*http.Request, string, error) {}
+	}
+	if p.OnDisconnect == nil {
+		p.OnDisconnect = func(read, wrote int64) {}
+	}
+
+	var ver [1]byte
+	if _, err := io.ReadFull(conn, ver[:]); err != nil {
+		return
+	}
+
+	var (
+		r     *http.Request
+		err   error
+		reply func(net.Conn, error) error
+	)
+	switch ver[0] {
+	case socks4Version:
+		r, err = socks4Request(conn)
+		reply = socks4Reply
+	case socks5Version:
+		r, err = socks5Request(conn)
+		reply = socks5Reply
+	default:
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	backends, err := p.candidates(r)
+	if err != nil {
+		_ = reply(conn, err)
+		return
+	}
+
+	ctx, stop := watch(conn)
+	t, _, err := p.tunnel(r.WithContext(ctx), backends)
+	conn = stop()
+	if err != nil {
+		_ = reply(conn, err)
+		return
+	}
+	defer func() {
+		_ = t.inbound.Close()
+	}()
+
+	if p.Sessions != nil {
+		p.Sessions.pin(r, t.backend.URL)
+	}
+
+	if p.Tunnels != nil {
+		p.Tunnels.open(t.backend.URL)
+		defer p.Tunnels.close(t.backend.URL)
+	}
+
+	if err := reply(conn, nil); err != nil {
+		return
+	}
+	p.OnDisconnect(pipe(t.inbound, conn))
+}
+
+// watch returns the context which is canceled once the SOCKS client closes the connection so that Proxy stops trying
+// backends for it. The returned function stops watching and returns the connection including the bytes the client
+// sent in the meantime.
+func watch(conn net.Conn) (context.Context, func() net.Conn) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var buf [1]byte
+	var n int
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var err error
+		n, err = conn.Read(buf[:])
+		if err != nil {
+			cancel()
+		}
+	}()
+	return ctx, func() net.Conn {
+		_ = conn.SetReadDeadline(time.Unix(1, 0))
+		<-done
+		cancel()
+		_ = conn.SetReadDeadline(time.Time{})
+		if n == 0 {
+			return conn
+		}
+		return &watchedConn{Conn: conn, r: io.MultiReader(bytes.NewReader(buf[:n]), conn)}
+	}
+}
+
+// watchedConn is a connection with the bytes read while it was watched.
+type watchedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *watchedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// errSOCKSCommand is the error for a SOCKS request other than CONNECT.
+var errSOCKSCommand = errors.New("socks: command not supported")
+
+// socks4Request reads the request from a SOCKS4/4a client following the version and returns the synthetic CONNECT
+// request for it.
+func socks4Request(conn net.Conn) (*http.Request, error) {
+	var b [7]byte
+	if _, err := io.ReadFull(conn, b[:]); err != nil {
+		return nil, err
+	}
+
+	userID, err := socks4ReadString(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	host := net.IP(b[3:7]).String()
+	if b[3] == 0 && b[4] == 0 && b[5] == 0 && b[6] != 0 {
+		// SOCKS4a: the host name follows the user ID.
+		host, err = socks4ReadString(conn)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if b[0] != socks4Connect {
+		_ = socks4Reply(conn, errSOCKSCommand)
+		return nil, errSOCKSCommand
+	}
+
+	return socksConnect(conn, net.JoinHostPort(host, strconv.Itoa(int(b[1])<<8|int(b[2]))), userID), nil
+}
+
+// socks4ReadString reads a NUL-terminated string from a SOCKS4 client.
+func socks4ReadString(conn net.Conn) (string, error) {
+	var (
+		s []byte
+		b [1]byte
+	)
+	for {
+		if _, err := io.ReadFull(conn, b[:]); err != nil {
+			return "", err
+		}
+		if b[0] == 0x00 {
+			return string(s), nil
+		}
+		if len(s) == 255 {
+			return "", errors.New("socks: too long string")
+		}
+		s = append(s, b[0])
+	}
+}
+
+// socks4Reply replies to a SOCKS4 client with the result of the request.
+func socks4Reply(conn net.Conn, err error) error {
+	code := byte(socks4Granted)
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrInvalidProxyAuthorization), errors.Is(err, ErrProxyAuthRequired):
+		code = socks4BadUser
+	default:
+		code = socks4Rejected
+	}
+	_, werr := conn.Write([]byte{0x00, code, 0, 0, 0, 0, 0, 0})
+	return werr
+}
+
+// socks5Request negotiates with a SOCKS5 client following the version and returns the synthetic CONNECT request for it.
+func socks5Request(conn net.Conn) (*http.Request, error) {
+	var b [4]byte
+	if _, err := io.ReadFull(conn, b[:1]); err != nil {
+		return nil, err
+	}
+	methods := make([]byte, b[0])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return nil, err
+	}
+
+	// Prefer username/password since they're the source of the template variables.
+	method := byte(socks5NoAcceptable)
+	for _, m := range methods {
+		switch {
+		case m == socks5UserPass:
+			method = m
+		case m == socks5NoAuth && method == socks5NoAcceptable:
+			method = m
+		}
+	}
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+		return nil, err
+	}
+
+	var credentials string
+	switch method {
+	case socks5UserPass:
+		c, err := socks5ReadAuth(conn)
+		if err != nil {
+			return nil, err
+		}
+		credentials = c
+	case socks5NoAcceptable:
+		return nil, errors.New("socks: no acceptable authentication methods")
+	}
+
+	if _, err := io.ReadFull(conn, b[:4]); err != nil {
+		return nil, err
+	}
+	if b[0] != socks5Version {
+		return nil, errors.New("socks: unexpected version")
+	}
+
+	var host string
+	switch b[3] {
+	case socks5IPv4, socks5IPv6:
+		n := net.IPv4len
+		if b[3] == socks5IPv6 {
+			n = net.IPv6len
+		}
+		ip := make(net.IP, n)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return nil, err
+		}
+		host = ip.String()
+	case socks5Domain:
+		if _, err := io.ReadFull(conn, b[:1]); err != nil {
+			return nil, err
+		}
+		name := make([]byte, b[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return nil, err
+		}
+		host = string(name)
+	default:
+		_, _ = conn.Write([]byte{socks5Version, 0x08, 0x00, socks5IPv4, 0, 0, 0, 0, 0, 0})
+		return nil, errors.New("socks: address type not supported")
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(conn, port[:]); err != nil {
+		return nil, err
+	}
+
+	if b[1] != socks5Connect {
+		_ = socks5Reply(conn, errSOCKSCommand)
+		return nil, errSOCKSCommand
+	}
+
+	return socksConnect(conn, net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1]))), credentials), nil
+}
+
+// socks5ReadAuth reads the username and the password from a SOCKS5 client (RFC 1929) and accepts them. It returns
+// them as `username:password`. They're not verified here but used for the template variables.
+func socks5ReadAuth(conn net.Conn) (string, error) {
+	var b [2]byte
+	if _, err := io.ReadFull(conn, b[:]); err != nil {
+		return "", err
+	}
+	username := make([]byte, b[1])
+	if _, err := io.ReadFull(conn, username); err != nil {
+		return "", err
+	}
+	if _, err := io.ReadFull(conn, b[:1]); err != nil {
+		return "", err
+	}
+	password := make([]byte, b[0])
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return "", err
+	}
+	if _, err := conn.Write([]byte{0x01, 0x00}); err != nil {
+		return "", err
+	}
+	return string(username) + ":" + string(password), nil
+}
+
+// socks5Reply replies to a SOCKS5 client with the result of the request.
+func socks5Reply(conn net.Conn, err error) error {
+	_, werr := conn.Write([]byte{socks5Version, socksReplyCode(err), 0x00, socks5IPv4, 0, 0, 0, 0, 0, 0})
+	return werr
+}
+
+// socksReplyCode returns the SOCKS5 reply code for the error.
+func socksReplyCode(err error) byte {
+	var replyErr *socksReplyError
+	switch {
+	case err == nil:
+		return 0x00
+	case errors.Is(err, errSOCKSCommand):
+		return 0x07
+	case errors.Is(err, ErrInvalidProxyAuthorization), errors.Is(err, ErrProxyAuthRequired), errors.Is(err, ErrNoApplicableBackend):
+		return 0x02
+	case errors.Is(err, ErrTimeout):
+		return 0x06
+	case errors.As(err, &replyErr):
+		return replyErr.code
+	case errors.Is(err, ErrUnavailable):
+		return 0x04
+	default:
+		return 0x01
+	}
+}
+
+// socksConnect returns a synthetic CONNECT request for a SOCKS client. The credentials of the client, if any, are
+// passed as they are in Proxy-Authorization header.
+func socksConnect(conn net.Conn, target string, credentials string) *http.Request {
+	r := http.Request{
+		Method:     http.MethodConnect,
+		URL:        &url.URL{Host: target},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Body:       http.NoBody,
+		Host:       target,
+		RemoteAddr: conn.RemoteAddr().String(),
+		RequestURI: target,
+	}
+	if credentials != "" {
+		r.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)))
+	}
+	return &r
+}
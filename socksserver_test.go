@@ -0,0 +1,312 @@
+package httpproxyfailover
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestSOCKS_ServeConn(t *testing.T) {
+	origin := echoServer(t)
+	defer func() {
+		assert.NoError(t, origin.Close())
+	}()
+
+	backend := socks5Server(t, "user", "pass")
+	defer func() {
+		assert.NoError(t, backend.Close())
+	}()
+
+	wrong := fmt.Sprintf("socks5://{user}:wrong@%s", backend.Addr())
+	right := fmt.Sprintf("socks5://{user}:pass@%s", backend.Addr())
+
+	var c MockCallback
+	c.On("OnConnect", mock.MatchedBy(func(r *http.Request) bool {
+		return r.Method == http.MethodConnect && r.RequestURI == origin.Addr().String()
+	}), fmt.Sprintf("socks5://user:wrong@%s", backend.Addr()), errSOCKSAuth).Return()
+	c.On("OnConnect", mock.MatchedBy(func(r *http.Request) bool {
+		return r.Method == http.MethodConnect && r.RequestURI == origin.Addr().String()
+	}), fmt.Sprintf("socks5://user:pass@%s", backend.Addr()), nil).Return()
+	disconnected := make(chan struct{})
+	c.On("OnDisconnect", int64(4), int64(4)).Run(func(mock.Arguments) {
+		close(disconnected)
+	}).Return()
+	defer c.AssertExpectations(t)
+
+	p := Proxy{
+		Backends:     []string{wrong, right},
+		OnConnect:    c.OnConnect,
+		OnDisconnect: c.OnDisconnect,
+	}
+	assert.NoError(t, p.EnableTemplates())
+	s := SOCKS{Proxy: &p}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go func() {
+		_ = s.Serve(l)
+	}()
+	defer func() {
+		assert.NoError(t, l.Close())
+	}()
+
+	t.Run("OK", func(t *testing.T) {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		assert.NoError(t, err)
+
+		u := &url.URL{Scheme: "socks5", User: url.UserPassword("user=user", "whatever"), Host: l.Addr().String()}
+		assert.NoError(t, socks5(context.Background(), conn, u, origin.Addr().String()))
+
+		_, err = conn.Write([]byte("ping"))
+		assert.NoError(t, err)
+		b := make([]byte, 4)
+		_, err = io.ReadFull(conn, b)
+		assert.NoError(t, err)
+		assert.Equal(t, "ping", string(b))
+		assert.NoError(t, conn.Close())
+
+		<-disconnected
+	})
+
+	t.Run("no applicable backend", func(t *testing.T) {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		assert.NoError(t, err)
+		defer func() {
+			assert.NoError(t, conn.Close())
+		}()
+
+		u := &url.URL{Scheme: "socks5", Host: l.Addr().String()}
+		assert.Equal(t, &socksReplyError{code: 0x02}, socks5(context.Background(), conn, u, origin.Addr().String()))
+	})
+}
+
+func TestSOCKS_ServeConn_socks4(t *testing.T) {
+	origin := echoServer(t)
+	defer func() {
+		assert.NoError(t, origin.Close())
+	}()
+
+	backend := socks4Server(t, "user")
+	defer func() {
+		assert.NoError(t, backend.Close())
+	}()
+
+	var c MockCallback
+	c.On("OnConnect", mock.MatchedBy(func(r *http.Request) bool {
+		return r.Method == http.MethodConnect && r.RequestURI == origin.Addr().String()
+	}), fmt.Sprintf("socks4a://user@%s", backend.Addr()), nil).Return()
+	disconnected := make(chan struct{})
+	c.On("OnDisconnect", int64(4), int64(4)).Run(func(mock.Arguments) {
+		close(disconnected)
+	}).Return()
+	defer c.AssertExpectations(t)
+
+	p := Proxy{
+		Backends:     []string{fmt.Sprintf("socks4a://{user}@%s", backend.Addr())},
+		OnConnect:    c.OnConnect,
+		OnDisconnect: c.OnDisconnect,
+	}
+	assert.NoError(t, p.EnableTemplates())
+	s := SOCKS{Proxy: &p}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go func() {
+		_ = s.Serve(l)
+	}()
+	defer func() {
+		assert.NoError(t, l.Close())
+	}()
+
+	t.Run("OK", func(t *testing.T) {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		assert.NoError(t, err)
+
+		u := &url.URL{Scheme: "socks4a", User: url.User("user=user"), Host: l.Addr().String()}
+		assert.NoError(t, socks4(context.Background(), conn, u, origin.Addr().String()))
+
+		_, err = conn.Write([]byte("ping"))
+		assert.NoError(t, err)
+		b := make([]byte, 4)
+		_, err = io.ReadFull(conn, b)
+		assert.NoError(t, err)
+		assert.Equal(t, "ping", string(b))
+		assert.NoError(t, conn.Close())
+
+		<-disconnected
+	})
+
+	t.Run("proxy authentication required", func(t *testing.T) {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		assert.NoError(t, err)
+		defer func() {
+			assert.NoError(t, conn.Close())
+		}()
+
+		u := &url.URL{Scheme: "socks4a", Host: l.Addr().String()}
+		assert.Equal(t, errSOCKSAuth, socks4(context.Background(), conn, u, origin.Addr().String()))
+	})
+}
+
+func TestSOCKS_ServeConn_canceled(t *testing.T) {
+	// The backend never responds.
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer func() {
+		assert.NoError(t, backend.Close())
+	}()
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, c := range conns {
+				_ = c.Close()
+			}
+		}()
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+
+	var c MockCallback
+	c.On("OnConnect", mock.AnythingOfType("*http.Request"), fmt.Sprintf("http://%s", backend.Addr()), context.Canceled).Return()
+	defer c.AssertExpectations(t)
+
+	s := SOCKS{Proxy: &Proxy{
+		Backends:  []string{fmt.Sprintf("http://%s", backend.Addr())},
+		OnConnect: c.OnConnect,
+	}}
+
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.ServeConn(server)
+	}()
+
+	_, err = client.Write([]byte{socks5Version, 1, 0x00})
+	assert.NoError(t, err)
+	_, err = io.ReadFull(client, make([]byte, 2))
+	assert.NoError(t, err)
+	_, err = client.Write([]byte{socks5Version, 0x01, 0x00, 0x01, 127, 0, 0, 1, 0x01, 0xbb})
+	assert.NoError(t, err)
+
+	// The trial is canceled once the client goes away.
+	assert.NoError(t, client.Close())
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		assert.Fail(t, "still trying backends")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	t.Run("closed", func(t *testing.T) {
+		client, server := net.Pipe()
+		ctx, stop := watch(server)
+		assert.NoError(t, client.Close())
+		<-ctx.Done()
+		stop()
+	})
+
+	t.Run("sent", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer func() {
+			assert.NoError(t, client.Close())
+		}()
+		ctx, stop := watch(server)
+		go func() {
+			_, _ = client.Write([]byte("ping"))
+		}()
+		time.Sleep(10 * time.Millisecond)
+		assert.NoError(t, ctx.Err())
+
+		// The bytes read while watching aren't lost.
+		conn := stop()
+		b := make([]byte, 4)
+		_, err := io.ReadFull(conn, b)
+		assert.NoError(t, err)
+		assert.Equal(t, "ping", string(b))
+	})
+}
+
+func TestSOCKS_Serve(t *testing.T) {
+	errClosed := errors.New("closed")
+	l := acceptErrors{temporaryError{}, temporaryError{}, errClosed}
+	s := SOCKS{Proxy: &Proxy{}}
+
+	// Temporary errors don't stop serving.
+	assert.Equal(t, errClosed, s.Serve(&l))
+	assert.Empty(t, l)
+}
+
+// acceptErrors is a listener which fails with the errors in order.
+type acceptErrors []error
+
+func (l *acceptErrors) Accept() (net.Conn, error) {
+	err := (*l)[0]
+	*l = (*l)[1:]
+	return nil, err
+}
+
+func (l *acceptErrors) Close() error {
+	return nil
+}
+
+func (l *acceptErrors) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string {
+	return "temporary"
+}
+
+func (temporaryError) Timeout() bool {
+	return false
+}
+
+func (temporaryError) Temporary() bool {
+	return true
+}
+
+func TestSocksConnect(t *testing.T) {
+	conn, _ := net.Pipe()
+	defer func() {
+		assert.NoError(t, conn.Close())
+	}()
+
+	// The credentials map to the same template variables as the ones in Proxy-Authorization header.
+	r := socksConnect(conn, "example.com:443", "path=a/b@c?d:p@ss")
+	assert.Equal(t, "Basic "+base64.StdEncoding.EncodeToString([]byte("path=a/b@c?d:p@ss")), r.Header.Get("Proxy-Authorization"))
+	values, err := params(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "a/b@c?d", values.Get("path").String())
+
+	r = socksConnect(conn, "example.com:443", "")
+	assert.Empty(t, r.Header.Get("Proxy-Authorization"))
+}
+
+func TestSocksReplyCode(t *testing.T) {
+	assert.Equal(t, byte(0x00), socksReplyCode(nil))
+	assert.Equal(t, byte(0x02), socksReplyCode(ErrProxyAuthRequired))
+	assert.Equal(t, byte(0x04), socksReplyCode(ErrUnavailable))
+	assert.Equal(t, byte(0x05), socksReplyCode(&FailFastError{Err: &socksReplyError{code: 0x05}}))
+	assert.Equal(t, byte(0x06), socksReplyCode(ErrTimeout))
+	assert.Equal(t, byte(0x01), socksReplyCode(ErrBudgetExhausted))
+	assert.Equal(t, byte(0x07), socksReplyCode(errSOCKSCommand))
+}
@@ -0,0 +1,46 @@
+package httpproxyfailover
+
+import "sync"
+
+// Tunnels counts live tunnels through each backend HTTP proxy.
+type Tunnels struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// Count returns the number of live tunnels through the backend.
+func (t *Tunnels) Count(backend string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.counts[backend]
+}
+
+// Counts returns a snapshot of the numbers of live tunnels keyed by backends.
+// Backends without live tunnels are omitted.
+func (t *Tunnels) Counts() map[string]int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ret := make(map[string]int, len(t.counts))
+	for b, n := range t.counts {
+		ret[b] = n
+	}
+	return ret
+}
+
+func (t *Tunnels) open(backend string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.counts == nil {
+		t.counts = map[string]int{}
+	}
+	t.counts[backend]++
+}
+
+func (t *Tunnels) close(backend string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.counts[backend]--
+	if t.counts[backend] <= 0 {
+		delete(t.counts, backend)
+	}
+}
@@ -0,0 +1,24 @@
+package httpproxyfailover
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTunnels(t *testing.T) {
+	var tunnels Tunnels
+	assert.Equal(t, 0, tunnels.Count("a"))
+	assert.Empty(t, tunnels.Counts())
+
+	tunnels.open("a")
+	tunnels.open("a")
+	tunnels.open("b")
+	assert.Equal(t, 2, tunnels.Count("a"))
+	assert.Equal(t, map[string]int{"a": 2, "b": 1}, tunnels.Counts())
+
+	tunnels.close("a")
+	tunnels.close("b")
+	assert.Equal(t, 1, tunnels.Count("a"))
+	assert.Equal(t, map[string]int{"a": 1}, tunnels.Counts())
+}